@@ -8,10 +8,21 @@ import (
 
 	"github.com/brianshea2/addr.tools/internal/config"
 	"github.com/brianshea2/addr.tools/internal/dnsutil"
+	"github.com/brianshea2/addr.tools/internal/ttlstore"
 	"github.com/miekg/dns"
 )
 
-func keygen(zone string, alg uint8) {
+func keygen(zone string, alg uint8, zsk bool) {
+	if zsk {
+		key, priv, err := dnsutil.GenerateDnssecKey(dns.CanonicalName(zone), dnsutil.FlagsZSK, alg, 1800)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		privKey, _ := dnsutil.PrivKeyBytes(key, priv)
+		fmt.Printf("%s ;privKey: %s\n", key, base64.StdEncoding.EncodeToString(privKey))
+		os.Exit(0)
+	}
 	dnssecProvider, err := dnsutil.GenerateDnssecProvider(dns.CanonicalName(zone), alg, 1800)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -23,19 +34,60 @@ func keygen(zone string, alg uint8) {
 	os.Exit(0)
 }
 
+// converts a database snapshot, and its journal if any, to a snapshot in another format
+func convert(args []string) {
+	var format string
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	flags.StringVar(&format, "f", "binary", "output `format`, binary or json")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s convert [-f format] input output\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	snapshotFormat, err := ttlstore.ParseSnapshotFormat(format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	store := &ttlstore.SimpleTtlStore{Format: snapshotFormat}
+	if err = store.LoadFile(flags.Arg(0)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = store.WriteFile(flags.Arg(1)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("wrote %v values as %v\n", store.Size(), snapshotFormat)
+	os.Exit(0)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "convert" {
+		convert(os.Args[2:])
+	}
 	var keygenAlg uint
+	var keygenZsk bool
 	var configPath, keygenZone string
 	flag.StringVar(&configPath, "c", "", "configuration `file`")
 	flag.StringVar(&keygenZone, "k", "", "generate DNSSEC keys for the specified `zone` and exit")
 	flag.UintVar(&keygenAlg, "a", uint(dns.ECDSAP256SHA256), "use `algorithm` when generating DNSSEC keys")
+	flag.BoolVar(&keygenZsk, "z", false, "generate a zone signing key instead of a key signing key")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n       %s convert [-f format] input output\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 	if len(configPath) == 0 && len(keygenZone) == 0 {
 		flag.Usage()
 		os.Exit(2)
 	}
 	if len(keygenZone) > 0 {
-		keygen(keygenZone, uint8(keygenAlg))
+		keygen(keygenZone, uint8(keygenAlg), keygenZsk)
 	}
 	// load config, go!
 	config := config.ParseConfig(configPath)
@@ -1,7 +1,7 @@
 package config
 
 import (
-	"bufio"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
@@ -12,13 +12,15 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/brianshea2/addr.tools/internal/dns2json"
 	"github.com/brianshea2/addr.tools/internal/dnsutil"
 	"github.com/brianshea2/addr.tools/internal/httputil"
+	"github.com/brianshea2/addr.tools/internal/logfile"
+	"github.com/brianshea2/addr.tools/internal/metrics"
 	"github.com/brianshea2/addr.tools/internal/status"
 	"github.com/brianshea2/addr.tools/internal/ttlstore"
 	"github.com/brianshea2/addr.tools/internal/zones/challenges"
@@ -33,19 +35,40 @@ import (
 const (
 	MaxDnscheckWatchers          = 100
 	MaxDnscheckLargeResponseRate = 10 // per second
+	MaxSigCacheSize              = 100000
+	MaxRateLimitEntries          = 100000
+	CookieSecretRotation         = 24 * time.Hour
+	DatabaseCompactionInterval   = 10 * time.Minute
 )
 
 type Config struct {
 	HTTPSocketPath        string
 	RequestLogPath        string
+	RequestLogFormat      string // text or json
+	RequestLogFilter      *dnsutil.RequestLogFilter
+	DnstapSocketPath      string
+	DnstapFilePath        string
 	DatabasePath          string
+	DatabaseSync          string // journal fsync policy: periodic (default), always, or never
+	DatabaseFormat        string // snapshot format: binary or json, defaults to that of the existing snapshot, or json
+	BoltDatabasePath      string // embedded transactional database, used instead of DatabasePath if set
 	ValkeyURL             string
 	TLSCertPath           string
 	TLSKeyPath            string
+	EnableDoQ             bool
+	EnableCookies         bool
+	CookieSecret          string // shared by instances, random and rotated if empty
+	TsigKey               string // base64, derives TSIG secrets for dns updates, shared by instances; updates are refused if empty
+	ServerID              string // answers id.server. CH TXT and NSID queries if set
+	ServerVersion         string // answers version.server. CH TXT queries if set
 	LookupUpstream        string
 	IPInfoBaseURL         string
 	MyaddrTurnstileSecret string
-	DnscheckZones         []struct {
+	RateLimit             struct {
+		*dnsutil.RateLimitingHandler
+		LogPath string
+	}
+	DnscheckZones []struct {
 		*dnscheck.DnscheckHandler
 		PrivateKey string
 	}
@@ -89,33 +112,174 @@ func ParsePrivateKey(s string) []byte {
 }
 
 func (config *Config) Run() {
+	// served zones, for request logs
+	var zones []string
+	handle := func(zone string, handler dns.Handler) {
+		dns.Handle(zone, handler)
+		zones = append(zones, zone)
+	}
+
+	// log files reopened on SIGHUP
+	var logFiles []*logfile.File
+
 	// init status handler, uptime
 	statusHandler := new(status.StatusHandler)
 	statusHandler.Add(status.NewUptimeProvider())
-	dns.Handle("status.", (&dnsutil.SimpleHandler{
+	healthChecker := new(status.HealthChecker)
+	healthChecker.Start()
+	statusHandler.Health = healthChecker
+	handle("status.", (&dnsutil.SimpleHandler{
 		Zone:            "status.",
 		Ns:              []string{"invalid."}, // not delegated
 		RecordGenerator: statusHandler,
+		Nsid:            config.ServerID,
 	}).Init(nil))
 
 	// init dns request logger
 	var requestLogger *log.Logger
 	if len(config.RequestLogPath) > 0 {
-		requestLogFile, err := os.OpenFile(config.RequestLogPath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
+		requestLogFile, err := logfile.Open(config.RequestLogPath, true)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer requestLogFile.Close()
+		logFiles = append(logFiles, requestLogFile)
+		switch config.RequestLogFormat {
+		case "", "text":
+			requestLogger = log.New(requestLogFile, "", log.LstdFlags)
+		case "json":
+			requestLogger = log.New(requestLogFile, "", 0)
+		default:
+			log.Fatalf("invalid request log format: %v", config.RequestLogFormat)
+		}
+		if config.RequestLogFilter != nil {
+			if err := config.RequestLogFilter.Init(); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	// init dnstap request logger
+	var dnstapLogger *dnsutil.DnstapLogger
+	if len(config.DnstapSocketPath) > 0 || len(config.DnstapFilePath) > 0 {
+		var err error
+		if len(config.DnstapSocketPath) > 0 {
+			dnstapLogger, err = dnsutil.NewDnstapSocketLogger(config.DnstapSocketPath)
+		} else {
+			dnstapLogger, err = dnsutil.NewDnstapFileLogger(config.DnstapFilePath)
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
-		buffer := bufio.NewWriter(requestLogFile)
-		defer buffer.Flush()
-		requestLogger = log.New(buffer, "", log.LstdFlags)
+		defer dnstapLogger.Close()
+		dnstapLogger.Identity = config.ServerID
+		if len(dnstapLogger.Identity) == 0 {
+			dnstapLogger.Identity, _ = os.Hostname()
+		}
+		dnstapLogger.Version = "addrd"
+		statusHandler.Add(status.StatusProviderFunc(func() []status.Status {
+			return []status.Status{{Title: "dnstap dropped", Value: dnstapLogger.Dropped()}}
+		}))
+		metrics.NewCounterFunc("addrd_dnstap_dropped_total", "dnstap messages dropped.", func() float64 {
+			return float64(dnstapLogger.Dropped())
+		})
 	}
 	dnsHandler := &dnsutil.LoggingHandler{
 		Logger: requestLogger,
-		Next:   dns.DefaultServeMux,
+		JSON:   config.RequestLogFormat == "json",
+		Filter: config.RequestLogFilter,
+		Dnstap: dnstapLogger,
+	}
+	statusHandler.Add(status.StatusProviderFunc(func() []status.Status {
+		return []status.Status{{Title: "dns requests", Value: dnsHandler.RequestCount()}}
+	}))
+
+	// init dns cookies
+	var cookies *dnsutil.ServerCookies
+	if config.EnableCookies {
+		secret := ParsePrivateKey(config.CookieSecret)
+		var err error
+		cookies, err = dnsutil.NewServerCookies(secret)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if secret == nil {
+			go func() {
+				log.Fatal(cookies.RotatePeriodically(CookieSecretRotation))
+			}()
+		}
 	}
+
+	// init chaos class server identification
+	dnsHandler.Next = &dnsutil.ChaosHandler{
+		Identity: config.ServerID,
+		Version:  config.ServerVersion,
+		Cookies:  cookies,
+		Next:     dns.DefaultServeMux,
+	}
+
+	// init response rate limiting
+	var rootHandler dns.Handler = dnsHandler
+	if config.RateLimit.RateLimitingHandler != nil {
+		rrl := config.RateLimit.RateLimitingHandler
+		rrl.Next = dnsHandler
+		rrl.MaxSize = MaxRateLimitEntries
+		rrl.Cookies = cookies
+		if len(config.RateLimit.LogPath) > 0 {
+			rrlLogFile, err := logfile.Open(config.RateLimit.LogPath, false)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer rrlLogFile.Close()
+			logFiles = append(logFiles, rrlLogFile)
+			rrl.Logger = log.New(rrlLogFile, "", log.LstdFlags)
+		}
+		rrl.Init()
+		go rrl.PrunePeriodically(time.Minute)
+		statusHandler.Add(status.StatusProviderFunc(func() []status.Status {
+			return []status.Status{
+				{Title: "rate limiting tracked", Value: rrl.Size()},
+				{Title: "rate limiting dropped", Value: rrl.Dropped()},
+				{Title: "rate limiting truncated", Value: rrl.Truncated()},
+			}
+		}))
+		metrics.NewGaugeFunc("addrd_rrl_tracked", "Responses tracked by rate limiting.", func() float64 {
+			return float64(rrl.Size())
+		})
+		metrics.NewCounterFunc("addrd_rrl_dropped_total", "Responses dropped by rate limiting.", func() float64 {
+			return float64(rrl.Dropped())
+		})
+		metrics.NewCounterFunc("addrd_rrl_truncated_total", "Responses truncated by rate limiting.", func() float64 {
+			return float64(rrl.Truncated())
+		})
+		rootHandler = rrl
+	}
+
+	// init TSIG key lookup for dns updates
+	tsigMux := new(dnsutil.TsigMux)
+	tsigKey := ParsePrivateKey(config.TsigKey)
+	if len(tsigKey) > 0 && len(tsigKey) < 16 {
+		log.Fatal("TsigKey must be at least 16 bytes")
+	}
+
+	// init dnssec signature cache
+	sigCache := &dnsutil.SigCache{MaxSize: MaxSigCacheSize}
 	statusHandler.Add(status.StatusProviderFunc(func() []status.Status {
-		return []status.Status{{Title: "dns requests", Value: strconv.FormatUint(dnsHandler.RequestCount(), 10)}}
+		return []status.Status{
+			{Title: "signature cache size", Value: sigCache.Size()},
+			{Title: "signature cache hits", Value: sigCache.Hits()},
+			{Title: "signature cache misses", Value: sigCache.Misses()},
+		}
 	}))
+	metrics.NewGaugeFunc("addrd_dnssec_signature_cache_size", "Signed rrsets in the signature cache.", func() float64 {
+		return float64(sigCache.Size())
+	})
+	metrics.NewCounterFunc("addrd_dnssec_signature_cache_hits_total", "Signature cache hits.", func() float64 {
+		return float64(sigCache.Hits())
+	})
+	metrics.NewCounterFunc("addrd_dnssec_signature_cache_misses_total", "Signature cache misses.", func() float64 {
+		return float64(sigCache.Misses())
+	})
 
 	// init valkey client
 	var valkeyClient valkey.Client
@@ -129,31 +293,74 @@ func (config *Config) Run() {
 		}
 		defer valkeyClient.Close()
 		log.Printf("[info] connected to %v", config.ValkeyURL)
+		healthChecker.AddReadiness("valkey", (&ttlstore.ValkeyClient{Client: valkeyClient}).Ping)
 	}
 
 	// init persistent data store
 	var persistentStore ttlstore.TtlStore
-	if valkeyClient == nil {
+	switch {
+	case valkeyClient != nil:
+		persistentStore = &ttlstore.ValkeyClient{Client: valkeyClient}
+	case len(config.BoltDatabasePath) > 0:
+		boltStore, err := ttlstore.OpenBoltTtlStore(config.BoltDatabasePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer boltStore.Close()
+		go boltStore.PrunePeriodically(time.Hour, func(err error) {
+			log.Printf("[error] BoltTtlStore.Prune: %v", err)
+		})
+		log.Printf("[info] opened database, size %v", boltStore.Size())
+		persistentStore = boltStore
+	default:
 		simpleStore := &ttlstore.SimpleTtlStore{}
 		go simpleStore.PrunePeriodically(time.Hour)
 		if len(config.DatabasePath) > 0 {
+			syncPolicy, err := ttlstore.ParseSyncPolicy(config.DatabaseSync)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if len(config.DatabaseFormat) > 0 {
+				simpleStore.Format, err = ttlstore.ParseSnapshotFormat(config.DatabaseFormat)
+			} else {
+				// keep the format until changed, json is readable by older versions
+				simpleStore.Format, err = ttlstore.DetectSnapshotFormat(config.DatabasePath)
+				if errors.Is(err, fs.ErrNotExist) {
+					simpleStore.Format, err = ttlstore.SnapshotJSON, nil
+				}
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
 			if err := simpleStore.LoadFile(config.DatabasePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
 				log.Fatal(err)
 			}
+			if err := simpleStore.OpenJournal(config.DatabasePath, syncPolicy); err != nil {
+				log.Fatal(err)
+			}
 			defer func() {
 				if err := simpleStore.WriteFile(config.DatabasePath); err != nil {
 					log.Printf("[error] %v", err)
 				}
+				if err := simpleStore.CloseJournal(); err != nil {
+					log.Printf("[error] %v", err)
+				}
 			}()
-			go func() {
-				log.Fatal(simpleStore.WriteFilePeriodically(config.DatabasePath, time.Minute))
-			}()
+			// changes are journaled, snapshots compact the journal
+			go simpleStore.WriteFilePeriodically(config.DatabasePath, DatabaseCompactionInterval, func(err error) {
+				log.Printf("[error] SimpleTtlStore.WriteFile: %v", err)
+			})
+			healthChecker.AddLiveness("database writer", func(context.Context) error {
+				return simpleStore.WriteError()
+			})
 			log.Printf("[info] loaded database, size %v", simpleStore.Size())
 		}
 		persistentStore = simpleStore
-	} else {
-		persistentStore = &ttlstore.ValkeyClient{Client: valkeyClient}
 	}
+	persistentStore = &ttlstore.Instrumented{Store: persistentStore, Name: "persistent"}
+	// changes made by other instances sharing valkey are picked up by periodic refreshes
+	observedPersistentStore := &ttlstore.Observed{Store: persistentStore}
+	persistentStore = observedPersistentStore
 
 	// init temporary challenge record store
 	var challengeStore ttlstore.TtlStore
@@ -167,6 +374,16 @@ func (config *Config) Run() {
 			Prefix: "challenge:",
 		}
 	}
+	challengeStore = &ttlstore.Instrumented{Store: challengeStore, Name: "challenge"}
+	observedChallengeStore := &ttlstore.Observed{Store: challengeStore}
+	challengeStore = observedChallengeStore
+
+	// checks that signed zones are refreshing SOA signatures
+	checkSoaSigs := func(h *dnsutil.SimpleHandler) {
+		if h.DnssecProvider != nil {
+			healthChecker.AddReadiness("soa signatures "+h.Zone, h.CheckSoaSigs)
+		}
+	}
 
 	// init and set dnscheck handlers
 	if len(config.DnscheckZones) > 0 {
@@ -183,38 +400,86 @@ func (config *Config) Run() {
 			h.DnscheckHandler.IPInfoClient = ipinfoClient
 			h.DnscheckHandler.LargeResponseLimiter = largeResponseLimiter
 			h.DnscheckHandler.Watchers = watcherHub
+			h.DnscheckHandler.Cookies = cookies
+			h.DnscheckHandler.Nsid = config.ServerID
+			if h.DnscheckHandler.DnssecProvider != nil {
+				h.DnscheckHandler.DnssecProvider.SigCache = sigCache
+			}
 			h.DnscheckHandler.Init(ParsePrivateKey(h.PrivateKey))
-			dns.Handle(h.DnscheckHandler.Zone, h.DnscheckHandler)
+			handle(h.DnscheckHandler.Zone, h.DnscheckHandler)
 		}
 		http.Handle("/watch/{watcher}", dnscheck.NewWebsocketHandler(watcherHub))
 		statusHandler.Add(status.StatusProviderFunc(func() []status.Status {
-			return []status.Status{{Title: "watchers", Value: strconv.Itoa(watcherHub.Size())}}
+			return []status.Status{{Title: "watchers", Value: watcherHub.Size()}}
 		}))
+		metrics.NewGaugeFunc("addrd_dnscheck_watchers", "Registered dnscheck watchers.", func() float64 {
+			return float64(watcherHub.Size())
+		})
 	}
 
 	// init and set challenges handler
 	if config.ChallengesZone.SimpleHandler != nil {
-		config.ChallengesZone.SimpleHandler.RecordGenerator = &challenges.RecordGenerator{
+		challengesRecordGenerator := &challenges.RecordGenerator{
 			ChallengeStore: challengeStore,
+			TsigKey:        tsigKey,
+		}
+		config.ChallengesZone.SimpleHandler.RecordGenerator = challengesRecordGenerator
+		config.ChallengesZone.SimpleHandler.Cookies = cookies
+		config.ChallengesZone.SimpleHandler.Nsid = config.ServerID
+		config.ChallengesZone.SimpleHandler.TsigKeys = tsigMux
+		if config.ChallengesZone.SimpleHandler.DnssecProvider != nil {
+			config.ChallengesZone.SimpleHandler.DnssecProvider.SigCache = sigCache
 		}
 		config.ChallengesZone.SimpleHandler.Init(ParsePrivateKey(config.ChallengesZone.PrivateKey))
-		dns.Handle(config.ChallengesZone.SimpleHandler.Zone, config.ChallengesZone.SimpleHandler)
+		checkSoaSigs(config.ChallengesZone.SimpleHandler)
+		observedChallengeStore.Observe(func(key string) {
+			if dns.IsSubDomain(config.ChallengesZone.SimpleHandler.Zone, key) {
+				config.ChallengesZone.SimpleHandler.Changed()
+			}
+		})
+		handle(config.ChallengesZone.SimpleHandler.Zone, config.ChallengesZone.SimpleHandler)
+		tsigMux.Handle(config.ChallengesZone.SimpleHandler.Zone, challengesRecordGenerator)
+		for name, secret := range config.ChallengesZone.SimpleHandler.TransferKeys {
+			tsigMux.AddKey(name, ParsePrivateKey(secret))
+		}
 		http.Handle("/challenges", &challenges.HTTPHandler{
 			ChallengeStore: challengeStore,
 			Zone:           config.ChallengesZone.SimpleHandler.Zone,
+			TsigKey:        tsigKey,
 		})
 	}
 
 	// init and set dyn handler
 	if config.DynZone.SimpleHandler != nil {
-		config.DynZone.SimpleHandler.RecordGenerator = &dyn.RecordGenerator{
+		dynRecordGenerator := &dyn.RecordGenerator{
 			DataStore: persistentStore,
+			TsigKey:   tsigKey,
+		}
+		config.DynZone.SimpleHandler.RecordGenerator = dynRecordGenerator
+		config.DynZone.SimpleHandler.Cookies = cookies
+		config.DynZone.SimpleHandler.Nsid = config.ServerID
+		config.DynZone.SimpleHandler.TsigKeys = tsigMux
+		if config.DynZone.SimpleHandler.DnssecProvider != nil {
+			config.DynZone.SimpleHandler.DnssecProvider.SigCache = sigCache
 		}
 		config.DynZone.SimpleHandler.Init(ParsePrivateKey(config.DynZone.PrivateKey))
-		dns.Handle(config.DynZone.SimpleHandler.Zone, config.DynZone.SimpleHandler)
+		checkSoaSigs(config.DynZone.SimpleHandler)
+		observedPersistentStore.Observe(func(key string) {
+			// keys are the record name followed by ":ip4", ":ip6", or ":tsig"
+			name, _, _ := strings.Cut(key, ":")
+			if dns.IsSubDomain(config.DynZone.SimpleHandler.Zone, name) {
+				config.DynZone.SimpleHandler.Changed()
+			}
+		})
+		handle(config.DynZone.SimpleHandler.Zone, config.DynZone.SimpleHandler)
+		tsigMux.Handle(config.DynZone.SimpleHandler.Zone, dynRecordGenerator)
+		for name, secret := range config.DynZone.SimpleHandler.TransferKeys {
+			tsigMux.AddKey(name, ParsePrivateKey(secret))
+		}
 		http.Handle("/dyn", &dyn.HTTPHandler{
 			DataStore: persistentStore,
 			Zone:      config.DynZone.SimpleHandler.Zone,
+			TsigKey:   tsigKey,
 		})
 	}
 
@@ -222,13 +487,36 @@ func (config *Config) Run() {
 	if len(config.MyaddrZones) > 0 {
 		myaddrDataStore := &ttlstore.Prefixed{Store: persistentStore, Prefix: "myaddr:"}
 		myaddrChallengeStore := &ttlstore.Prefixed{Store: challengeStore, Prefix: "myaddr:"}
+		myaddrRecordGenerator := &myaddr.RecordGenerator{
+			DataStore:      myaddrDataStore,
+			ChallengeStore: myaddrChallengeStore,
+			TsigKey:        tsigKey,
+		}
 		for _, h := range config.MyaddrZones {
-			h.SimpleHandler.RecordGenerator = &myaddr.RecordGenerator{
-				DataStore:      myaddrDataStore,
-				ChallengeStore: myaddrChallengeStore,
+			h.SimpleHandler.RecordGenerator = myaddrRecordGenerator
+			h.SimpleHandler.Cookies = cookies
+			h.SimpleHandler.Nsid = config.ServerID
+			h.SimpleHandler.TsigKeys = tsigMux
+			if h.SimpleHandler.DnssecProvider != nil {
+				h.SimpleHandler.DnssecProvider.SigCache = sigCache
 			}
 			h.SimpleHandler.Init(ParsePrivateKey(h.PrivateKey))
-			dns.Handle(h.SimpleHandler.Zone, h.SimpleHandler)
+			checkSoaSigs(h.SimpleHandler)
+			observedPersistentStore.Observe(func(key string) {
+				if strings.HasPrefix(key, myaddrDataStore.Prefix) {
+					h.SimpleHandler.Changed()
+				}
+			})
+			observedChallengeStore.Observe(func(key string) {
+				if strings.HasPrefix(key, myaddrChallengeStore.Prefix) {
+					h.SimpleHandler.Changed()
+				}
+			})
+			handle(h.SimpleHandler.Zone, h.SimpleHandler)
+			tsigMux.Handle(h.SimpleHandler.Zone, myaddrRecordGenerator)
+			for name, secret := range h.SimpleHandler.TransferKeys {
+				tsigMux.AddKey(name, ParsePrivateKey(secret))
+			}
 		}
 		http.Handle("/admin/myaddr", &myaddr.AdminHandler{
 			DataStore:      myaddrDataStore,
@@ -245,66 +533,118 @@ func (config *Config) Run() {
 		http.Handle("/myaddr-update", &myaddr.UpdateHandler{
 			DataStore:      myaddrDataStore,
 			ChallengeStore: myaddrChallengeStore,
+			TsigKey:        tsigKey,
 		})
 	}
 
+	// set dns over https handler
+	http.Handle("/dns-query", &dnsutil.DohHandler{
+		Handler:      rootHandler,
+		TsigProvider: tsigMux,
+	})
+
 	// set dns lookup handler
 	if len(config.LookupUpstream) > 0 {
 		http.Handle("/dns/{name}/{type}", &dns2json.LookupHandler{Upstream: config.LookupUpstream})
 	}
 
-	// start dns listeners
+	// set metrics, status, and health handlers
+	http.Handle("/metrics", metrics.DefaultRegistry)
+	http.Handle("/status", statusHandler)
+	http.Handle("/healthz", healthChecker.Handler(false))
+	http.Handle("/readyz", healthChecker.Handler(true))
+
+	// set served zones
+	dnsHandler.Zones = zones
+
+	// start dns listeners, checked by querying the status zone over loopback
+	probeListener := func(name, network, addr string, tlsConfig *tls.Config) {
+		healthChecker.AddLiveness(name, func(ctx context.Context) error {
+			return dnsutil.Probe(ctx, network, addr, "status.", tlsConfig)
+		})
+	}
 	go func() {
 		log.Print("[info] starting dns udp listener")
 		log.Fatal((&dns.Server{
 			Addr:          ":53",
 			Net:           "udp",
 			MsgAcceptFunc: dnsutil.MsgAcceptFunc,
-			Handler:       dnsHandler,
+			Handler:       rootHandler,
+			TsigProvider:  tsigMux,
 		}).ListenAndServe())
 	}()
+	probeListener("dns udp listener", "udp", "127.0.0.1:53", nil)
 	go func() {
 		log.Print("[info] starting dns tcp listener")
 		log.Fatal((&dns.Server{
 			Addr:          ":53",
 			Net:           "tcp",
 			MsgAcceptFunc: dnsutil.MsgAcceptFunc,
-			Handler:       dnsHandler,
+			Handler:       rootHandler,
+			TsigProvider:  tsigMux,
 		}).ListenAndServe())
 	}()
+	probeListener("dns tcp listener", "tcp", "127.0.0.1:53", nil)
 	if len(config.TLSCertPath) > 0 && len(config.TLSKeyPath) > 0 {
+		cert, err := tls.LoadX509KeyPair(config.TLSCertPath, config.TLSKeyPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsConfig := &tls.Config{
+			NextProtos:   []string{"dot"},
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+			CurvePreferences: []tls.CurveID{
+				tls.X25519MLKEM768,
+				tls.X25519,
+				tls.CurveP256,
+				tls.CurveP384,
+			},
+			CipherSuites: []uint16{
+				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+				tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+				tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			},
+		}
 		go func() {
 			log.Print("[info] starting dns over tls listener")
-			cert, err := tls.LoadX509KeyPair(config.TLSCertPath, config.TLSKeyPath)
-			if err != nil {
-				log.Fatal(err)
-			}
 			log.Fatal((&dns.Server{
 				Addr:          ":853",
 				Net:           "tcp-tls",
 				MsgAcceptFunc: dnsutil.MsgAcceptFunc,
-				Handler:       dnsHandler,
-				TLSConfig: &tls.Config{
-					NextProtos:   []string{"dot"},
-					Certificates: []tls.Certificate{cert},
-					MinVersion:   tls.VersionTLS12,
-					CurvePreferences: []tls.CurveID{
-						tls.X25519MLKEM768,
-						tls.X25519,
-						tls.CurveP256,
-						tls.CurveP384,
-					},
-					CipherSuites: []uint16{
-						tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-						tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-						tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-						tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-						tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-						tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-					},
-				},
+				Handler:       rootHandler,
+				TsigProvider:  tsigMux,
+				TLSConfig:     tlsConfig,
 			}).ListenAndServe())
 		}()
+		// our own listener, the certificate's names needn't match
+		probeListener("dns over tls listener", "tcp-tls", "127.0.0.1:853", &tls.Config{
+			NextProtos:         []string{"dot"},
+			InsecureSkipVerify: true,
+		})
+		if config.EnableDoQ {
+			// quic requires tls 1.3
+			quicTLSConfig := tlsConfig.Clone()
+			quicTLSConfig.NextProtos = []string{"doq"}
+			quicTLSConfig.MinVersion = tls.VersionTLS13
+			go func() {
+				log.Print("[info] starting dns over quic listener")
+				log.Fatal((&dnsutil.DoqServer{
+					Addr:          ":853",
+					TLSConfig:     quicTLSConfig,
+					MsgAcceptFunc: dnsutil.MsgAcceptFunc,
+					Handler:       rootHandler,
+					TsigProvider:  tsigMux,
+				}).ListenAndServe())
+			}()
+			probeListener("dns over quic listener", "quic", "127.0.0.1:853", &tls.Config{
+				NextProtos:         []string{"doq"},
+				InsecureSkipVerify: true,
+			})
+		}
 	}
 
 	// start http socket listener
@@ -324,6 +664,19 @@ func (config *Config) Run() {
 		}()
 	}
 
+	// reopen log files on SIGHUP, e.g. after logrotate
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			for _, f := range logFiles {
+				if err := f.Reopen(); err != nil {
+					log.Printf("[error] %v", err)
+				}
+			}
+		}
+	}()
+
 	// goroutines are go-ing, wait
 	terminate := make(chan os.Signal, 1)
 	signal.Notify(terminate, syscall.SIGINT, syscall.SIGTERM)
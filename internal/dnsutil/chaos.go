@@ -0,0 +1,66 @@
+package dnsutil
+
+import (
+	"github.com/miekg/dns"
+)
+
+// answers CHAOS class TXT queries identifying the server (rfc4892), passing other queries to Next.
+// names with an empty value are refused.
+type ChaosHandler struct {
+	Identity string // id.server. and hostname.bind.
+	Version  string // version.server. and version.bind.
+	Cookies  *ServerCookies
+	Next     dns.Handler
+}
+
+func (h *ChaosHandler) value(name string) string {
+	switch ToLowerAscii(name) {
+	case "id.server.", "hostname.bind.":
+		return h.Identity
+	case "version.server.", "version.bind.":
+		return h.Version
+	}
+	return ""
+}
+
+func (h *ChaosHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	q := &req.Question[0]
+	if q.Qclass != dns.ClassCHAOS || req.Opcode != dns.OpcodeQuery {
+		h.Next.ServeDNS(w, req)
+		return
+	}
+	// prepare response, defer send
+	resp := new(dns.Msg).SetReply(req)
+	resp.Authoritative = true
+	defer func() {
+		w.WriteMsg(resp)
+	}()
+	// edns
+	err := CheckAndSetEdns(w, req, resp, h.Cookies, h.Identity)
+	if err != nil {
+		// Rcode already set by CheckAndSetEdns
+		return
+	}
+	// defer compress, truncate, padding
+	defer func() {
+		ResizeForTransport(req, resp, GetProtocol(w))
+	}()
+	value := h.value(q.Name)
+	if len(value) == 0 {
+		resp.Authoritative = false
+		resp.Rcode = dns.RcodeRefused
+		return
+	}
+	switch q.Qtype {
+	case dns.TypeTXT, dns.TypeANY:
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassCHAOS,
+				Ttl:    0,
+			},
+			Txt: SplitForTxt(value),
+		})
+	}
+}
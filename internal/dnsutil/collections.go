@@ -26,6 +26,17 @@ func (s StaticRecords) Get(question *dns.Question) (rrs []dns.RR, nameExists boo
 	return
 }
 
+// gets the types of records at name
+func (s StaticRecords) Types(name string) (types []uint16) {
+	for _, rr := range s {
+		hdr := rr.Header()
+		if hdr.Class == dns.ClassINET && EqualsAsciiIgnoreCase(hdr.Name, name) {
+			types = append(types, hdr.Rrtype)
+		}
+	}
+	return
+}
+
 func (s StaticRecords) MarshalJSON() ([]byte, error) {
 	var strs []string
 	for _, rr := range s {
@@ -0,0 +1,130 @@
+package dnsutil
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/dchest/siphash"
+	"github.com/miekg/dns"
+)
+
+const (
+	CookieSecretSize    = 16
+	CookieMaxAge        = 3600 // seconds
+	CookieMaxClockSkew  = 300  // seconds
+	serverCookieVersion = 1
+	serverCookieSize    = 16
+	clientCookieSize    = 8
+	minServerCookieSize = 8 // rfc7873
+	maxServerCookieSize = 32
+)
+
+// generates and validates interoperable server cookies (rfc9018). cookies made with the previous secret
+// remain valid after a rotation.
+type ServerCookies struct {
+	mu       sync.RWMutex
+	current  []byte
+	previous []byte
+}
+
+// creates ServerCookies with secret, or a random secret if nil
+func NewServerCookies(secret []byte) (*ServerCookies, error) {
+	c := new(ServerCookies)
+	if secret == nil {
+		return c, c.Rotate()
+	}
+	if len(secret) != CookieSecretSize {
+		return nil, fmt.Errorf("cookie secret must be %v bytes", CookieSecretSize)
+	}
+	c.current = secret
+	return c, nil
+}
+
+// replaces the secret with a random one
+func (c *ServerCookies) Rotate() error {
+	secret := make([]byte, CookieSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.previous, c.current = c.current, secret
+	return nil
+}
+
+func (c *ServerCookies) RotatePeriodically(interval time.Duration) error {
+	for {
+		time.Sleep(interval)
+		if err := c.Rotate(); err != nil {
+			return err
+		}
+	}
+}
+
+// gets the rfc9018 hash of the client cookie, cookie header, and client address
+func serverCookieHash(secret, clientCookie, header []byte, addr netip.Addr) []byte {
+	b := make([]byte, 0, clientCookieSize+8+16)
+	b = append(b, clientCookie...)
+	b = append(b, header...)
+	b = append(b, addr.AsSlice()...)
+	return binary.LittleEndian.AppendUint64(nil, siphash.Hash(
+		binary.LittleEndian.Uint64(secret[:8]),
+		binary.LittleEndian.Uint64(secret[8:]),
+		b,
+	))
+}
+
+// gets a new server cookie for the client cookie and address
+func (c *ServerCookies) Generate(clientCookie []byte, addr netip.Addr) []byte {
+	header := make([]byte, 8)
+	header[0] = serverCookieVersion
+	binary.BigEndian.PutUint32(header[4:], uint32(time.Now().Unix()))
+	c.mu.RLock()
+	secret := c.current
+	c.mu.RUnlock()
+	return append(header, serverCookieHash(secret, clientCookie, header, addr)...)
+}
+
+// checks if cookie, a client cookie followed by a server cookie, was generated by us for the address
+func (c *ServerCookies) Valid(cookie []byte, addr netip.Addr) bool {
+	if c == nil || len(cookie) != clientCookieSize+serverCookieSize {
+		return false
+	}
+	clientCookie, header, hash := cookie[:clientCookieSize], cookie[clientCookieSize:clientCookieSize+8], cookie[clientCookieSize+8:]
+	if header[0] != serverCookieVersion {
+		return false
+	}
+	if age := int32(uint32(time.Now().Unix()) - binary.BigEndian.Uint32(header[4:])); age > CookieMaxAge || age < -CookieMaxClockSkew {
+		return false
+	}
+	c.mu.RLock()
+	current, previous := c.current, c.previous
+	c.mu.RUnlock()
+	for _, secret := range [][]byte{current, previous} {
+		if secret != nil && subtle.ConstantTimeCompare(serverCookieHash(secret, clientCookie, header, addr), hash) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// checks if req has a valid server cookie for the address
+func hasValidCookie(req *dns.Msg, addr netip.Addr, cookies *ServerCookies) bool {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0COOKIE {
+			cookie, err := hex.DecodeString(o.(*dns.EDNS0_COOKIE).Cookie)
+			return err == nil && cookies.Valid(cookie, addr)
+		}
+	}
+	return false
+}
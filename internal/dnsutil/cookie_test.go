@@ -0,0 +1,61 @@
+package dnsutil
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/netip"
+	"testing"
+)
+
+// rfc9018 appendix A.1 and A.2
+var cookieVectors = []struct {
+	name         string
+	clientCookie string
+	secret       string
+	client       string
+	serverCookie string
+}{
+	{"A.1", "2464c4abcf10c957", "e5e973e5a6b2a43f48e7dc849e37bfcf", "198.51.100.100", "010000005cf79f111f8130c3eee29480"},
+	{"A.2", "2464c4abcf10c957", "e5e973e5a6b2a43f48e7dc849e37bfcf", "198.51.100.100", "010000005cf7a871d4a564a1442aca77"},
+}
+
+func TestServerCookieHash(t *testing.T) {
+	for _, v := range cookieVectors {
+		clientCookie, _ := hex.DecodeString(v.clientCookie)
+		secret, _ := hex.DecodeString(v.secret)
+		serverCookie, _ := hex.DecodeString(v.serverCookie)
+		header, want := serverCookie[:8], serverCookie[8:]
+		got := serverCookieHash(secret, clientCookie, header, netip.MustParseAddr(v.client))
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %x, want %x", v.name, got, want)
+		}
+	}
+}
+
+func TestServerCookies(t *testing.T) {
+	c, err := NewServerCookies(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCookie, _ := hex.DecodeString("fc93fc62807ddb86")
+	addr := netip.MustParseAddr("2001:db8:220:1:59de:d0f4:8769:82b8")
+	cookie := append(clientCookie, c.Generate(clientCookie, addr)...)
+	if !c.Valid(cookie, addr) {
+		t.Error("generated cookie not valid")
+	}
+	if c.Valid(cookie, netip.MustParseAddr("2001:db8:8f::53")) {
+		t.Error("cookie valid for another address")
+	}
+	if err = c.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Valid(cookie, addr) {
+		t.Error("cookie not valid after one rotation")
+	}
+	if err = c.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Valid(cookie, addr) {
+		t.Error("cookie valid after two rotations")
+	}
+}
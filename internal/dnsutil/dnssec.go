@@ -8,6 +8,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"math/big"
+	"slices"
 	"time"
 
 	"github.com/miekg/dns"
@@ -23,52 +24,144 @@ var DefaultNsecTypes = []uint16{
 	dns.TypeRRSIG,
 	dns.TypeNSEC,
 	dns.TypeDNSKEY,
+	dns.TypeCDS,
+	dns.TypeCDNSKEY,
 	dns.TypeHTTPS,
 }
 
+const (
+	FlagsKSK = 257 // Zone Key, Secure Entry Point
+	FlagsZSK = 256 // Zone Key
+)
+
+// a zone signing key, published and used for signing according to its schedule.
+// zero times are ignored, e.g., a key with only Retire and Remove set is active until Retire.
+// when rolling keys, Remove should be at least one signature lifetime after Retire.
+type ZoneSigningKey struct {
+	*dns.DNSKEY
+	PrivateKey string // base64
+	Publish    time.Time
+	Activate   time.Time
+	Retire     time.Time
+	Remove     time.Time
+	signer     crypto.Signer
+}
+
+// checks if the key should be in the DNSKEY rrset at time t
+func (k *ZoneSigningKey) IsPublished(t time.Time) bool {
+	return !t.Before(k.Publish) && (k.Remove.IsZero() || t.Before(k.Remove))
+}
+
+// checks if the key should sign rrsets at time t
+func (k *ZoneSigningKey) IsActive(t time.Time) bool {
+	return k.IsPublished(t) && !t.Before(k.Activate) && (k.Retire.IsZero() || t.Before(k.Retire))
+}
+
 type DnssecProvider struct {
-	SigningKey *dns.DNSKEY
-	PrivateKey crypto.Signer
-	NsecTypes  []uint16
+	SigningKey      *dns.DNSKEY // the key signing key, or the only key if ZoneSigningKeys is empty
+	PrivateKey      crypto.Signer
+	ZoneSigningKeys []*ZoneSigningKey
+	NsecTypes       []uint16
+	Nsec3           *Nsec3Params // use NSEC3 white lies instead of NSEC black lies if set
+	PublishCds      bool         // publish CDS/CDNSKEY for the key signing key (rfc7344)
+	DeleteDs        bool         // publish the delete-DS CDS/CDNSKEY sentinel instead (rfc8078)
+	SigCache        *SigCache    // caches signatures made with the default validity period if set
 }
 
-func GenerateDnssecProvider(name string, algo uint8, rrTtl uint32) (*DnssecProvider, error) {
-	p := &DnssecProvider{
-		SigningKey: &dns.DNSKEY{
-			Hdr: dns.RR_Header{
-				Name:   name,
-				Rrtype: dns.TypeDNSKEY,
-				Class:  dns.ClassINET,
-				Ttl:    rrTtl,
-			},
-			Flags:     257, // Secure Entry Point
-			Protocol:  3,   // DNSSEC
-			Algorithm: algo,
-		},
-	}
-	switch algo {
+func generateKey(key *dns.DNSKEY) (crypto.Signer, error) {
+	switch key.Algorithm {
 	case dns.ECDSAP256SHA256:
-		key, err := p.SigningKey.Generate(256)
+		priv, err := key.Generate(256)
 		if err != nil {
 			return nil, err
 		}
-		p.PrivateKey = key.(*ecdsa.PrivateKey)
+		return priv.(*ecdsa.PrivateKey), nil
 	case dns.ECDSAP384SHA384:
-		key, err := p.SigningKey.Generate(384)
+		priv, err := key.Generate(384)
 		if err != nil {
 			return nil, err
 		}
-		p.PrivateKey = key.(*ecdsa.PrivateKey)
+		return priv.(*ecdsa.PrivateKey), nil
 	case dns.ED25519:
-		key, err := p.SigningKey.Generate(256)
+		priv, err := key.Generate(256)
 		if err != nil {
 			return nil, err
 		}
-		p.PrivateKey = key.(ed25519.PrivateKey)
+		return priv.(ed25519.PrivateKey), nil
 	default:
-		return nil, fmt.Errorf("unsupported algorithm: %v", algo)
+		return nil, fmt.Errorf("unsupported algorithm: %v", key.Algorithm)
+	}
+}
+
+func GenerateDnssecKey(name string, flags uint16, algo uint8, rrTtl uint32) (*dns.DNSKEY, crypto.Signer, error) {
+	key := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    rrTtl,
+		},
+		Flags:     flags,
+		Protocol:  3, // DNSSEC
+		Algorithm: algo,
+	}
+	priv, err := generateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, priv, nil
+}
+
+func GenerateDnssecProvider(name string, algo uint8, rrTtl uint32) (*DnssecProvider, error) {
+	key, priv, err := GenerateDnssecKey(name, FlagsKSK, algo, rrTtl)
+	if err != nil {
+		return nil, err
 	}
-	return p, nil
+	return &DnssecProvider{SigningKey: key, PrivateKey: priv}, nil
+}
+
+// sets the name and fixed fields of all keys, loads private keys
+func (p *DnssecProvider) Init(zone string, rrTtl uint32, privKeyBytes []byte) error {
+	if p == nil || p.SigningKey == nil {
+		return fmt.Errorf("missing signing key")
+	}
+	initKey := func(key *dns.DNSKEY, flags uint16) {
+		key.Hdr.Name = zone
+		key.Hdr.Rrtype = dns.TypeDNSKEY
+		key.Hdr.Class = dns.ClassINET
+		key.Hdr.Ttl = rrTtl
+		key.Flags = flags
+		key.Protocol = 3 // DNSSEC
+	}
+	initKey(p.SigningKey, FlagsKSK)
+	err := p.SetPrivKeyBytes(privKeyBytes)
+	if err != nil {
+		return err
+	}
+	if p.Nsec3 != nil {
+		err = p.Nsec3.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	for _, k := range p.ZoneSigningKeys {
+		if k.DNSKEY == nil {
+			return fmt.Errorf("missing zone signing key")
+		}
+		initKey(k.DNSKEY, FlagsZSK)
+		b, err := base64.StdEncoding.DecodeString(k.PrivateKey)
+		if err == nil && len(b) == 0 {
+			err = fmt.Errorf("missing private key")
+		}
+		if err != nil {
+			return fmt.Errorf("cannot decode zone signing key %v: %w", k.KeyTag(), err)
+		}
+		k.signer, err = parsePrivKeyBytes(k.DNSKEY, b)
+		if err != nil {
+			return fmt.Errorf("zone signing key %v: %w", k.KeyTag(), err)
+		}
+	}
+	return nil
 }
 
 func (p *DnssecProvider) DS() (*dns.DS, error) {
@@ -85,57 +178,123 @@ func (p *DnssecProvider) DS() (*dns.DS, error) {
 	}
 }
 
-func (p *DnssecProvider) PrivKeyBytes() ([]byte, error) {
-	if p == nil || p.SigningKey == nil {
-		return nil, fmt.Errorf("missing signing key")
+// checks if CDS/CDNSKEY rrsets are published at the apex
+func (p *DnssecProvider) HasCds() bool {
+	return p != nil && p.SigningKey != nil && (p.PublishCds || p.DeleteDs)
+}
+
+// gets the apex CDS or CDNSKEY rrset, named name
+func (p *DnssecProvider) Cds(name string, rrtype uint16) ([]dns.RR, error) {
+	if !p.HasCds() {
+		return nil, nil
 	}
-	switch p.SigningKey.Algorithm {
+	hdr := dns.RR_Header{
+		Name:   name,
+		Rrtype: rrtype,
+		Class:  dns.ClassINET,
+		Ttl:    p.SigningKey.Hdr.Ttl,
+	}
+	switch rrtype {
+	case dns.TypeCDS:
+		if p.DeleteDs {
+			return []dns.RR{&dns.CDS{DS: dns.DS{Hdr: hdr, Digest: "00"}}}, nil
+		}
+		ds, err := p.DS()
+		if err != nil {
+			return nil, err
+		}
+		ds.Hdr = hdr
+		return []dns.RR{&dns.CDS{DS: *ds}}, nil
+	case dns.TypeCDNSKEY:
+		if p.DeleteDs {
+			return []dns.RR{&dns.CDNSKEY{DNSKEY: dns.DNSKEY{Hdr: hdr, Protocol: 3, PublicKey: "AA=="}}}, nil
+		}
+		key := *p.SigningKey
+		key.Hdr = hdr
+		return []dns.RR{&dns.CDNSKEY{DNSKEY: key}}, nil
+	}
+	return nil, nil
+}
+
+func PrivKeyBytes(key *dns.DNSKEY, priv crypto.Signer) ([]byte, error) {
+	switch key.Algorithm {
 	case dns.ECDSAP256SHA256, dns.ECDSAP384SHA384:
-		return p.PrivateKey.(*ecdsa.PrivateKey).D.Bytes(), nil
+		return priv.(*ecdsa.PrivateKey).D.Bytes(), nil
 	case dns.ED25519:
-		return p.PrivateKey.(ed25519.PrivateKey).Seed(), nil
+		return priv.(ed25519.PrivateKey).Seed(), nil
 	default:
-		return nil, fmt.Errorf("unsupported algorithm: %v", p.SigningKey.Algorithm)
+		return nil, fmt.Errorf("unsupported algorithm: %v", key.Algorithm)
 	}
 }
 
-func (p *DnssecProvider) SetPrivKeyBytes(b []byte) error {
-	if p == nil || p.SigningKey == nil {
-		return fmt.Errorf("missing signing key")
-	}
-	switch p.SigningKey.Algorithm {
+func parsePrivKeyBytes(key *dns.DNSKEY, b []byte) (crypto.Signer, error) {
+	switch key.Algorithm {
 	case dns.ECDSAP256SHA256, dns.ECDSAP384SHA384:
-		pubBytes, err := base64.StdEncoding.DecodeString(p.SigningKey.PublicKey)
+		pubBytes, err := base64.StdEncoding.DecodeString(key.PublicKey)
 		if err != nil {
-			return fmt.Errorf("cannot decode public key: %w", err)
+			return nil, fmt.Errorf("cannot decode public key: %w", err)
 		}
 		var curve elliptic.Curve
-		switch p.SigningKey.Algorithm {
+		switch key.Algorithm {
 		case dns.ECDSAP256SHA256:
 			if len(pubBytes) != 64 {
-				return fmt.Errorf("wrong public key length: %v", len(pubBytes))
+				return nil, fmt.Errorf("wrong public key length: %v", len(pubBytes))
 			}
 			curve = elliptic.P256()
 		case dns.ECDSAP384SHA384:
 			if len(pubBytes) != 96 {
-				return fmt.Errorf("wrong public key length: %v", len(pubBytes))
+				return nil, fmt.Errorf("wrong public key length: %v", len(pubBytes))
 			}
 			curve = elliptic.P384()
 		}
-		p.PrivateKey = &ecdsa.PrivateKey{
+		return &ecdsa.PrivateKey{
 			PublicKey: ecdsa.PublicKey{
 				Curve: curve,
 				X:     new(big.Int).SetBytes(pubBytes[:len(pubBytes)/2]),
 				Y:     new(big.Int).SetBytes(pubBytes[len(pubBytes)/2:]),
 			},
 			D: new(big.Int).SetBytes(b),
-		}
+		}, nil
 	case dns.ED25519:
-		p.PrivateKey = ed25519.NewKeyFromSeed(b)
+		return ed25519.NewKeyFromSeed(b), nil
 	default:
-		return fmt.Errorf("unsupported algorithm: %v", p.SigningKey.Algorithm)
+		return nil, fmt.Errorf("unsupported algorithm: %v", key.Algorithm)
 	}
-	return nil
+}
+
+func (p *DnssecProvider) PrivKeyBytes() ([]byte, error) {
+	if p == nil || p.SigningKey == nil {
+		return nil, fmt.Errorf("missing signing key")
+	}
+	return PrivKeyBytes(p.SigningKey, p.PrivateKey)
+}
+
+func (p *DnssecProvider) SetPrivKeyBytes(b []byte) (err error) {
+	if p == nil || p.SigningKey == nil {
+		return fmt.Errorf("missing signing key")
+	}
+	p.PrivateKey, err = parsePrivKeyBytes(p.SigningKey, b)
+	return
+}
+
+// gets the keys which sign rrsets of type rrtype at time t
+func (p *DnssecProvider) activeKeys(rrtype uint16, t time.Time) (keys []*dns.DNSKEY, signers []crypto.Signer) {
+	// key rrsets are signed by the key signing key only
+	switch rrtype {
+	case dns.TypeDNSKEY, dns.TypeCDS, dns.TypeCDNSKEY:
+	default:
+		for _, k := range p.ZoneSigningKeys {
+			if k.IsActive(t) {
+				keys = append(keys, k.DNSKEY)
+				signers = append(signers, k.signer)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		keys = append(keys, p.SigningKey)
+		signers = append(signers, p.PrivateKey)
+	}
+	return
 }
 
 func (p *DnssecProvider) Sign(rrs []dns.RR, validFrom, validTo uint32) (sigs []dns.RR, err error) {
@@ -145,64 +304,163 @@ func (p *DnssecProvider) Sign(rrs []dns.RR, validFrom, validTo uint32) (sigs []d
 	if len(rrs) == 0 {
 		return
 	}
-	var now uint32
-	if validFrom == 0 || validTo == 0 {
-		now = uint32(time.Now().Unix())
-		if validFrom == 0 {
-			validFrom = now - 3600
-		}
+	t := time.Now()
+	now := uint32(t.Unix())
+	useCache := p.SigCache != nil && validFrom == 0 && validTo == 0
+	if validFrom == 0 {
+		validFrom = now - 3600
+	}
+	// rrsets are grouped by owner name and type
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
 	}
-	rrsByType := make(map[uint16][]dns.RR)
-	typesAlreadySigned := make(map[uint16]struct{})
+	var keys []rrsetKey
+	rrsets := make(map[rrsetKey][]dns.RR)
+	alreadySigned := make(map[rrsetKey]struct{})
 	for _, rr := range rrs {
-		rrtype := rr.Header().Rrtype
-		if rrtype == dns.TypeRRSIG {
-			typesAlreadySigned[rr.(*dns.RRSIG).TypeCovered] = struct{}{}
-		} else {
-			rrsByType[rrtype] = append(rrsByType[rrtype], rr)
+		name := ToLowerAscii(rr.Header().Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			alreadySigned[rrsetKey{name, sig.TypeCovered}] = struct{}{}
+			continue
 		}
+		key := rrsetKey{name, rr.Header().Rrtype}
+		if _, exists := rrsets[key]; !exists {
+			keys = append(keys, key)
+		}
+		rrsets[key] = append(rrsets[key], rr)
 	}
-	for rrtype, rrsOfSameType := range rrsByType {
-		if _, alreadySigned := typesAlreadySigned[rrtype]; alreadySigned {
+	for _, key := range keys {
+		if _, signed := alreadySigned[key]; signed {
 			continue
 		}
+		rrset := rrsets[key]
 		expiration := validTo
 		if expiration == 0 {
-			expiration = now + 3600 + rrsOfSameType[0].Header().Ttl
+			expiration = now + 3600 + rrset[0].Header().Ttl
 		}
-		sig := &dns.RRSIG{
-			Hdr:        dns.RR_Header{Ttl: rrsOfSameType[0].Header().Ttl},
-			Algorithm:  p.SigningKey.Algorithm,
-			Expiration: expiration,
-			Inception:  validFrom,
-			KeyTag:     p.SigningKey.KeyTag(),
-			SignerName: p.SigningKey.Hdr.Name,
+		dnskeys, signers := p.activeKeys(key.rrtype, t)
+		var cacheKey string
+		if useCache {
+			cacheKey = sigCacheKey(rrset, dnskeys)
+			if cached := p.SigCache.get(cacheKey, rrset[0].Header().Name, now); cached != nil {
+				sigs = append(sigs, cached...)
+				continue
+			}
 		}
-		err = sig.Sign(p.PrivateKey, rrsOfSameType)
-		if err != nil {
-			return
+		newSigs := make([]*dns.RRSIG, 0, len(dnskeys))
+		for i, dnskey := range dnskeys {
+			sig := &dns.RRSIG{
+				Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+				Algorithm:  dnskey.Algorithm,
+				Expiration: expiration,
+				Inception:  validFrom,
+				KeyTag:     dnskey.KeyTag(),
+				SignerName: dnskey.Hdr.Name,
+			}
+			err = sig.Sign(signers[i], rrset)
+			if err != nil {
+				return
+			}
+			dnssecSignatures.With(sig.SignerName).Inc()
+			sigs = append(sigs, sig)
+			cp := *sig
+			newSigs = append(newSigs, &cp)
+		}
+		if useCache {
+			p.SigCache.set(cacheKey, newSigs, expiration-rrset[0].Header().Ttl-SigCacheRefreshWindow)
 		}
-		sigs = append(sigs, sig)
 	}
 	return
 }
 
-// adds DNSKEY to resp if requested by req, returns true iff key was added
+// gets the DNSKEY rrset at time t
+func (p *DnssecProvider) Keys(t time.Time) []*dns.DNSKEY {
+	keys := []*dns.DNSKEY{p.SigningKey}
+	for _, k := range p.ZoneSigningKeys {
+		if k.IsPublished(t) {
+			keys = append(keys, k.DNSKEY)
+		}
+	}
+	return keys
+}
+
+// adds DNSKEYs to resp if requested by req, returns true iff keys were added
 func (p *DnssecProvider) ProvideKeys(req, resp *dns.Msg) bool {
 	if p == nil || p.SigningKey == nil {
 		return false
 	}
 	q := &req.Question[0]
 	if q.Qclass == dns.ClassINET && q.Qtype == dns.TypeDNSKEY && EqualsAsciiIgnoreCase(q.Name, p.SigningKey.Hdr.Name) {
-		resp.Answer = append(resp.Answer, dns.Copy(p.SigningKey))
-		resp.Answer[len(resp.Answer)-1].Header().Name = q.Name
+		for _, key := range p.Keys(time.Now()) {
+			resp.Answer = append(resp.Answer, dns.Copy(key))
+			resp.Answer[len(resp.Answer)-1].Header().Name = q.Name
+		}
 		return true
 	}
 	return false
 }
 
+// gets the types to list in an NSEC or NSEC3 bitmap of an existing name, excluding qtype.
+// existing lists the types of records at name if known, otherwise NsecTypes is used.
+func (p *DnssecProvider) typeBitMap(name string, qtype uint16, existing []uint16, nsec3 bool) []uint16 {
+	var types []uint16
+	isApex := EqualsAsciiIgnoreCase(name, p.SigningKey.Hdr.Name)
+	hasCds := isApex && p.HasCds()
+	if existing != nil {
+		types = make([]uint16, len(existing), len(existing)+5)
+		copy(types, existing)
+		types = append(types, dns.TypeRRSIG, dns.TypeNSEC)
+		if isApex {
+			types = append(types, dns.TypeDNSKEY)
+			if hasCds {
+				types = append(types, dns.TypeCDS, dns.TypeCDNSKEY)
+			}
+		}
+	} else if p.NsecTypes == nil {
+		types = make([]uint16, len(DefaultNsecTypes))
+		copy(types, DefaultNsecTypes)
+	} else {
+		types = make([]uint16, len(p.NsecTypes))
+		copy(types, p.NsecTypes)
+	}
+	for i := 0; i < len(types); {
+		if types[i] == qtype || (!isApex && (types[i] == dns.TypeNS ||
+			types[i] == dns.TypeSOA || types[i] == dns.TypeDNSKEY)) ||
+			(!hasCds && (types[i] == dns.TypeCDS || types[i] == dns.TypeCDNSKEY)) ||
+			(nsec3 && types[i] == dns.TypeNSEC) {
+			types = append(types[:i], types[i+1:]...) // remove
+			continue
+		}
+		i++
+	}
+	// NSEC3PARAM only exists with zone-wide NSEC3 parameters, see Nsec3Param
+	if nsec3 && isApex && p.Nsec3 != nil && qtype != dns.TypeNSEC3PARAM {
+		types = append(types, dns.TypeNSEC3PARAM)
+	}
+	slices.Sort(types)
+	return slices.Compact(types)
+}
+
+// options for proving a response
+type ProofOptions struct {
+	Nsec3 *Nsec3Params // use NSEC3 white lies with these parameters, NSEC black lies if nil
+	Types []uint16     // the types of records at the query name, NsecTypes is used if nil
+	// the types of records at the closest encloser of a non-existent query name with NSEC3,
+	// see nsec3Encloser, NsecTypes is used if nil
+	EncloserTypes []uint16
+}
+
 // adds DNSSEC signatures to resp
 func (p *DnssecProvider) Prove(req, resp *dns.Msg, validFrom, validTo uint32) error {
+	if p == nil {
+		return nil
+	}
+	return p.ProveWith(req, resp, validFrom, validTo, &ProofOptions{Nsec3: p.Nsec3})
+}
+
+// adds DNSSEC signatures to resp using opts
+func (p *DnssecProvider) ProveWith(req, resp *dns.Msg, validFrom, validTo uint32, opts *ProofOptions) error {
 	if p == nil || p.PrivateKey == nil {
 		return nil
 	}
@@ -223,40 +481,37 @@ func (p *DnssecProvider) Prove(req, resp *dns.Msg, validFrom, validTo uint32) er
 	// sign answer section
 	if len(resp.Answer) == 0 {
 		// prove non-existence
-		var types []uint16
-		if resp.Rcode == dns.RcodeNameError {
-			if !opt.Co() {
-				resp.Rcode = dns.RcodeSuccess
+		if opts.Nsec3 != nil {
+			existing := opts.Types
+			if resp.Rcode == dns.RcodeNameError {
+				existing = opts.EncloserTypes
 			}
-			types = []uint16{dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNXNAME}
-		} else {
-			if p.NsecTypes == nil {
-				types = make([]uint16, len(DefaultNsecTypes))
-				copy(types, DefaultNsecTypes)
-			} else {
-				types = make([]uint16, len(p.NsecTypes))
-				copy(types, p.NsecTypes)
+			rrs, err := p.nsec3Proof(q, resp.Rcode == dns.RcodeNameError, existing, opts.Nsec3)
+			if err != nil {
+				return err
 			}
-			isApex := EqualsAsciiIgnoreCase(q.Name, p.SigningKey.Hdr.Name)
-			for i := 0; i < len(types); {
-				if types[i] == q.Qtype || (!isApex && (types[i] == dns.TypeNS ||
-					types[i] == dns.TypeSOA || types[i] == dns.TypeDNSKEY)) {
-					types = append(types[:i], types[i+1:]...) // remove
-					continue
+			resp.Ns = append(resp.Ns, rrs...)
+		} else {
+			var types []uint16
+			if resp.Rcode == dns.RcodeNameError {
+				if !opt.Co() {
+					resp.Rcode = dns.RcodeSuccess
 				}
-				i++
+				types = []uint16{dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNXNAME}
+			} else {
+				types = p.typeBitMap(q.Name, q.Qtype, opts.Types, false)
 			}
+			resp.Ns = append(resp.Ns, &dns.NSEC{
+				Hdr: dns.RR_Header{
+					Name:   q.Name,
+					Rrtype: dns.TypeNSEC,
+					Class:  dns.ClassINET,
+					Ttl:    p.SigningKey.Hdr.Ttl,
+				},
+				NextDomain: "\\000." + ToLowerAscii(q.Name),
+				TypeBitMap: types,
+			})
 		}
-		resp.Ns = append(resp.Ns, &dns.NSEC{
-			Hdr: dns.RR_Header{
-				Name:   q.Name,
-				Rrtype: dns.TypeNSEC,
-				Class:  dns.ClassINET,
-				Ttl:    p.SigningKey.Hdr.Ttl,
-			},
-			NextDomain: "\\000." + ToLowerAscii(q.Name),
-			TypeBitMap: types,
-		})
 	} else {
 		sigs, err := p.Sign(resp.Answer, validFrom, validTo)
 		if err != nil {
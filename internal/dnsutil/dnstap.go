@@ -0,0 +1,146 @@
+package dnsutil
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+// DNS over QUIC (rfc9250) in the dnstap schema, not yet in the go bindings
+const dnstapSocketProtocolDOQ dnstap.SocketProtocol = 7
+
+// a dnstap (https://dnstap.info) emitter of AUTH_QUERY and AUTH_RESPONSE messages.
+// messages are dropped rather than delaying responses if the output falls behind.
+type DnstapLogger struct {
+	Identity string
+	Version  string
+	output   dnstap.Output
+	dropped  atomic.Uint64
+}
+
+// creates a DnstapLogger writing frame streams to a unix socket, reconnecting as needed
+func NewDnstapSocketLogger(path string) (*DnstapLogger, error) {
+	output, err := dnstap.NewFrameStreamSockOutput(&net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	return newDnstapLogger(output), nil
+}
+
+// creates a DnstapLogger writing frame streams to a file, truncating it
+func NewDnstapFileLogger(path string) (*DnstapLogger, error) {
+	output, err := dnstap.NewFrameStreamOutputFromFilename(path)
+	if err != nil {
+		return nil, err
+	}
+	return newDnstapLogger(output), nil
+}
+
+func newDnstapLogger(output dnstap.Output) *DnstapLogger {
+	go output.RunOutputLoop()
+	return &DnstapLogger{output: output}
+}
+
+// flushes and closes the output
+func (l *DnstapLogger) Close() {
+	l.output.Close()
+}
+
+func (l *DnstapLogger) Dropped() uint64 {
+	return l.dropped.Load()
+}
+
+// gets the address and port of a local or remote address
+func addrPort(a net.Addr) (addr netip.AddrPort, ok bool) {
+	var ip net.IP
+	var port int
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *DohAddr:
+		ip, port = a.IP, a.Port
+	case *DoqAddr:
+		ip, port = a.IP, a.Port
+	default:
+		return
+	}
+	ipAddr, ok := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(ipAddr.Unmap(), uint16(port)), ok
+}
+
+// logs the query req received at start, and resp if not nil, sent now. messages are repacked, so they may
+// differ from the wire data in compression.
+func (l *DnstapLogger) Log(w dns.ResponseWriter, req, resp *dns.Msg, start time.Time) {
+	msg := &dnstap.Message{
+		QueryTimeSec:  proto.Uint64(uint64(start.Unix())),
+		QueryTimeNsec: proto.Uint32(uint32(start.Nanosecond())),
+	}
+	switch GetProtocol(w) {
+	case ProtoUDP:
+		msg.SocketProtocol = dnstap.SocketProtocol_UDP.Enum()
+	case ProtoTCP:
+		msg.SocketProtocol = dnstap.SocketProtocol_TCP.Enum()
+	case ProtoTLS:
+		msg.SocketProtocol = dnstap.SocketProtocol_DOT.Enum()
+	case ProtoHTTPS:
+		msg.SocketProtocol = dnstap.SocketProtocol_DOH.Enum()
+	case ProtoQUIC:
+		msg.SocketProtocol = dnstapSocketProtocolDOQ.Enum()
+	}
+	if remote, ok := addrPort(w.RemoteAddr()); ok {
+		if remote.Addr().Is4() {
+			msg.SocketFamily = dnstap.SocketFamily_INET.Enum()
+		} else {
+			msg.SocketFamily = dnstap.SocketFamily_INET6.Enum()
+		}
+		msg.QueryAddress = remote.Addr().AsSlice()
+		msg.QueryPort = proto.Uint32(uint32(remote.Port()))
+	}
+	if local, ok := addrPort(w.LocalAddr()); ok {
+		msg.ResponseAddress = local.Addr().AsSlice()
+		msg.ResponsePort = proto.Uint32(uint32(local.Port()))
+	}
+	query := proto.Clone(msg).(*dnstap.Message)
+	query.Type = dnstap.Message_AUTH_QUERY.Enum()
+	query.QueryMessage, _ = req.Pack()
+	l.send(query)
+	if resp == nil {
+		return
+	}
+	now := time.Now()
+	msg.Type = dnstap.Message_AUTH_RESPONSE.Enum()
+	msg.ResponseTimeSec = proto.Uint64(uint64(now.Unix()))
+	msg.ResponseTimeNsec = proto.Uint32(uint32(now.Nanosecond()))
+	msg.ResponseMessage, _ = resp.Pack()
+	l.send(msg)
+}
+
+func (l *DnstapLogger) send(msg *dnstap.Message) {
+	dt := &dnstap.Dnstap{
+		Type:    dnstap.Dnstap_MESSAGE.Enum(),
+		Message: msg,
+	}
+	if len(l.Identity) > 0 {
+		dt.Identity = []byte(l.Identity)
+	}
+	if len(l.Version) > 0 {
+		dt.Version = []byte(l.Version)
+	}
+	b, err := proto.Marshal(dt)
+	if err != nil {
+		l.dropped.Add(1)
+		return
+	}
+	select {
+	case l.output.GetOutputChannel() <- b:
+	default:
+		l.dropped.Add(1)
+	}
+}
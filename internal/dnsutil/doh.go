@@ -0,0 +1,162 @@
+package dnsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DohMediaType     = "application/dns-message"
+	DohMaxMsgSize    = dns.MaxMsgSize
+	DohDefaultMaxAge = 3600
+)
+
+// the local address of dns over https requests
+type DohAddr struct {
+	net.TCPAddr
+}
+
+func (a *DohAddr) Network() string { return "https" }
+
+// a dns.ResponseWriter for dns over https requests
+type DohResponseWriter struct {
+	ctx            context.Context
+	localAddr      *DohAddr
+	remoteAddr     *net.TCPAddr
+	connState      *tls.ConnectionState // nil unless TLS is terminated by this server rather than a proxy
+	tsigProvider   dns.TsigProvider
+	tsigStatus     error
+	tsigRequestMAC string
+	tsigTimersOnly bool
+	msg            *dns.Msg
+	data           []byte
+}
+
+func (w *DohResponseWriter) LocalAddr() net.Addr                   { return w.localAddr }
+func (w *DohResponseWriter) RemoteAddr() net.Addr                  { return w.remoteAddr }
+func (w *DohResponseWriter) Close() error                          { return nil }
+func (w *DohResponseWriter) TsigStatus() error                     { return w.tsigStatus }
+func (w *DohResponseWriter) TsigTimersOnly(b bool)                 { w.tsigTimersOnly = b }
+func (w *DohResponseWriter) Hijack()                               {}
+func (w *DohResponseWriter) ConnectionState() *tls.ConnectionState { return w.connState }
+func (w *DohResponseWriter) Write(b []byte) (int, error)           { w.data = b; return len(b), nil }
+func (w *DohResponseWriter) Context() context.Context              { return w.ctx }
+
+func (w *DohResponseWriter) WriteMsg(m *dns.Msg) (err error) {
+	w.msg = m
+	if w.tsigProvider != nil && m.IsTsig() != nil {
+		w.data, w.tsigRequestMAC, err = dns.TsigGenerateWithProvider(m, w.tsigProvider, w.tsigRequestMAC, w.tsigTimersOnly)
+		return
+	}
+	w.data, err = m.Pack()
+	return
+}
+
+// determines the http cache lifetime of a dns response (rfc8484 section 5.1)
+func GetMaxAge(m *dns.Msg) uint32 {
+	if m == nil || m.Opcode != dns.OpcodeQuery || !(m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError) {
+		return 0
+	}
+	maxAge := uint32(DohDefaultMaxAge)
+	for _, rr := range m.Answer {
+		if rr.Header().Ttl < maxAge {
+			maxAge = rr.Header().Ttl
+		}
+	}
+	for _, rr := range m.Ns {
+		if rr.Header().Ttl < maxAge {
+			maxAge = rr.Header().Ttl
+		}
+		if soa, ok := rr.(*dns.SOA); ok && len(m.Answer) == 0 && soa.Minttl < maxAge {
+			maxAge = soa.Minttl
+		}
+	}
+	return maxAge
+}
+
+// an http.Handler which serves dns over https (rfc8484)
+type DohHandler struct {
+	Handler      dns.Handler
+	TsigProvider dns.TsigProvider
+}
+
+func (h *DohHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// read message
+	var data []byte
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		data, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		if err != nil || len(data) == 0 {
+			http.Error(w, "invalid value for \"dns\"", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != DohMediaType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err = io.ReadAll(http.MaxBytesReader(w, req.Body, DohMaxMsgSize))
+		if err != nil {
+			http.Error(w, "invalid body", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	dw := &DohResponseWriter{
+		ctx:          req.Context(),
+		localAddr:    new(DohAddr),
+		remoteAddr:   &net.TCPAddr{IP: net.ParseIP(req.Header.Get("X-Real-IP"))},
+		connState:    req.TLS,
+		tsigProvider: h.TsigProvider,
+	}
+	// filter messages the same way as dns.Server
+	if len(data) < 12 {
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+	dh := dns.Header{
+		Bits:    uint16(data[2])<<8 | uint16(data[3]),
+		Qdcount: uint16(data[4])<<8 | uint16(data[5]),
+	}
+	msg := new(dns.Msg)
+	if err = msg.Unpack(data); err != nil {
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+	switch MsgAcceptFunc(dh) {
+	case dns.MsgAccept:
+		if h.TsigProvider != nil {
+			if t := msg.IsTsig(); t != nil {
+				dw.tsigStatus = dns.TsigVerifyWithProvider(data, h.TsigProvider, "", false)
+				dw.tsigRequestMAC = t.MAC
+			}
+		}
+		h.Handler.ServeDNS(dw, msg)
+	case dns.MsgReject:
+		dw.WriteMsg(new(dns.Msg).SetRcodeFormatError(msg))
+	case dns.MsgRejectNotImplemented:
+		dw.WriteMsg(new(dns.Msg).SetRcode(msg, dns.RcodeNotImplemented))
+	default:
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+	// write response
+	if dw.data == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", DohMediaType)
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(GetMaxAge(dw.msg)), 10))
+	w.Write(dw.data)
+}
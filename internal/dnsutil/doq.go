@@ -0,0 +1,255 @@
+package dnsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// rfc9250 error codes
+const (
+	DoqNoError          = 0x0
+	DoqInternalError    = 0x1
+	DoqProtocolError    = 0x2
+	DoqRequestCancelled = 0x3
+	DoqExcessiveLoad    = 0x4
+)
+
+const (
+	DoqMaxIdleTimeout     = 30 * time.Second
+	DoqMaxIncomingStreams = 100
+	DoqStreamTimeout      = 10 * time.Second
+)
+
+// the local address of dns over quic requests
+type DoqAddr struct {
+	net.UDPAddr
+}
+
+func (a *DoqAddr) Network() string { return "quic" }
+
+// a dns.ResponseWriter for dns over quic streams
+type DoqResponseWriter struct {
+	conn           *quic.Conn
+	stream         *quic.Stream
+	localAddr      *DoqAddr
+	tsigProvider   dns.TsigProvider
+	tsigStatus     error
+	tsigRequestMAC string
+	tsigTimersOnly bool
+	connState      *tls.ConnectionState
+	written        bool
+}
+
+func (w *DoqResponseWriter) LocalAddr() net.Addr   { return w.localAddr }
+func (w *DoqResponseWriter) RemoteAddr() net.Addr  { return w.conn.RemoteAddr() }
+func (w *DoqResponseWriter) TsigStatus() error     { return w.tsigStatus }
+func (w *DoqResponseWriter) TsigTimersOnly(b bool) { w.tsigTimersOnly = b }
+func (w *DoqResponseWriter) Hijack()               {}
+
+// canceled when the connection is closed
+func (w *DoqResponseWriter) Context() context.Context {
+	return w.conn.Context()
+}
+
+func (w *DoqResponseWriter) ConnectionState() *tls.ConnectionState {
+	if w.connState == nil {
+		cstate := w.conn.ConnectionState().TLS
+		w.connState = &cstate
+	}
+	return w.connState
+}
+
+func (w *DoqResponseWriter) Close() error {
+	return w.stream.Close()
+}
+
+func (w *DoqResponseWriter) WriteMsg(m *dns.Msg) (err error) {
+	// message id must be 0
+	m.Id = 0
+	var data []byte
+	if w.tsigProvider != nil && m.IsTsig() != nil {
+		data, w.tsigRequestMAC, err = dns.TsigGenerateWithProvider(m, w.tsigProvider, w.tsigRequestMAC, w.tsigTimersOnly)
+	} else {
+		data, err = m.Pack()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (w *DoqResponseWriter) Write(b []byte) (int, error) {
+	if w.written {
+		return 0, errors.New("response already written")
+	}
+	w.written = true
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	if _, err := w.stream.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), w.stream.Close()
+}
+
+// a dns over quic (rfc9250) server
+type DoqServer struct {
+	Addr          string
+	TLSConfig     *tls.Config
+	Handler       dns.Handler
+	MsgAcceptFunc dns.MsgAcceptFunc
+	TsigProvider  dns.TsigProvider
+}
+
+func (srv *DoqServer) ListenAndServe() error {
+	ln, err := quic.ListenAddr(srv.Addr, srv.TLSConfig, &quic.Config{
+		MaxIdleTimeout:     DoqMaxIdleTimeout,
+		MaxIncomingStreams: DoqMaxIncomingStreams,
+	})
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go srv.serveConn(conn)
+	}
+}
+
+func (srv *DoqServer) serveConn(conn *quic.Conn) {
+	localAddr := &DoqAddr{}
+	if a, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		localAddr.UDPAddr = *a
+	}
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			// connection closed
+			return
+		}
+		go srv.serveStream(conn, stream, localAddr)
+	}
+}
+
+func (srv *DoqServer) serveStream(conn *quic.Conn, stream *quic.Stream, localAddr *DoqAddr) {
+	stream.SetDeadline(time.Now().Add(DoqStreamTimeout))
+	// read length-prefixed message
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		stream.CancelRead(DoqProtocolError)
+		stream.CancelWrite(DoqProtocolError)
+		return
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(stream, data); err != nil {
+		stream.CancelRead(DoqProtocolError)
+		stream.CancelWrite(DoqProtocolError)
+		return
+	}
+	w := &DoqResponseWriter{
+		conn:         conn,
+		stream:       stream,
+		localAddr:    localAddr,
+		tsigProvider: srv.TsigProvider,
+	}
+	defer func() {
+		if !w.written {
+			stream.CancelWrite(DoqInternalError)
+		}
+	}()
+	req := new(dns.Msg)
+	if err := req.Unpack(data); err != nil {
+		conn.CloseWithError(DoqProtocolError, "invalid message")
+		return
+	}
+	// message id must be 0
+	if req.Id != 0 {
+		conn.CloseWithError(DoqProtocolError, "non-zero message id")
+		return
+	}
+	acceptFunc := srv.MsgAcceptFunc
+	if acceptFunc == nil {
+		acceptFunc = dns.DefaultMsgAcceptFunc
+	}
+	dh := dns.Header{
+		Id:      req.Id,
+		Bits:    binary.BigEndian.Uint16(data[2:]),
+		Qdcount: binary.BigEndian.Uint16(data[4:]),
+		Ancount: binary.BigEndian.Uint16(data[6:]),
+		Nscount: binary.BigEndian.Uint16(data[8:]),
+		Arcount: binary.BigEndian.Uint16(data[10:]),
+	}
+	switch acceptFunc(dh) {
+	case dns.MsgAccept:
+		if srv.TsigProvider != nil {
+			if t := req.IsTsig(); t != nil {
+				w.tsigStatus = dns.TsigVerifyWithProvider(data, srv.TsigProvider, "", false)
+				w.tsigRequestMAC = t.MAC
+			}
+		}
+		srv.Handler.ServeDNS(w, req)
+	case dns.MsgReject:
+		w.WriteMsg(new(dns.Msg).SetRcodeFormatError(req))
+	case dns.MsgRejectNotImplemented:
+		w.WriteMsg(new(dns.Msg).SetRcode(req, dns.RcodeNotImplemented))
+	default:
+		stream.CancelWrite(DoqRequestCancelled)
+		w.written = true
+	}
+}
+
+// sends req to the dns over quic server at addr on a new connection, returns the response
+func DoqExchange(ctx context.Context, req *dns.Msg, addr string, tlsConfig *tls.Config) (*dns.Msg, error) {
+	conn, err := quic.DialAddr(ctx, addr, tlsConfig, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.CloseWithError(DoqNoError, "")
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	// message id must be 0
+	m := req.Copy()
+	m.Id = 0
+	b, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	if _, err = stream.Write(buf); err != nil {
+		return nil, err
+	}
+	// no more queries on this stream
+	stream.Close()
+	var length uint16
+	if err = binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	if _, err = io.ReadFull(stream, data); err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err = resp.Unpack(data); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -1,6 +1,8 @@
 package dnsutil
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
 
 	"github.com/miekg/dns"
@@ -11,8 +13,12 @@ const (
 	ResponsePaddingBlockLength = 468  // rfc8467
 )
 
-// checks for edns0 in req, sets edns0 in resp
-func CheckAndSetEdns(req, resp *dns.Msg) error {
+var ErrBadCookie = errors.New("bad server cookie")
+
+// checks for edns0 in req, sets edns0 in resp. if cookies is not nil, a server cookie is returned for any
+// client cookie, and invalid server cookies over udp get BADCOOKIE (rfc7873). if nsid is not empty, it is
+// returned to clients requesting it (rfc5001).
+func CheckAndSetEdns(w dns.ResponseWriter, req, resp *dns.Msg, cookies *ServerCookies, nsid string) error {
 	if opt := req.IsEdns0(); opt != nil {
 		if opt.Version() != 0 {
 			resp.SetEdns0(MaxUdpMsgSize, false) // can't rely on Do() here
@@ -39,6 +45,47 @@ func CheckAndSetEdns(req, resp *dns.Msg) error {
 				break
 			}
 		}
+		// nsid
+		if len(nsid) > 0 {
+			for _, o := range opt.Option {
+				if o.Option() == dns.EDNS0NSID {
+					respOpt := resp.IsEdns0()
+					respOpt.Option = append(respOpt.Option, &dns.EDNS0_NSID{
+						Code: dns.EDNS0NSID,
+						Nsid: hex.EncodeToString([]byte(nsid)),
+					})
+					break
+				}
+			}
+		}
+		// cookies
+		if cookies == nil {
+			return nil
+		}
+		for _, o := range opt.Option {
+			if o.Option() == dns.EDNS0COOKIE {
+				cookie, err := hex.DecodeString(o.(*dns.EDNS0_COOKIE).Cookie)
+				if err != nil || (len(cookie) != clientCookieSize &&
+					(len(cookie) < clientCookieSize+minServerCookieSize || len(cookie) > clientCookieSize+maxServerCookieSize)) {
+					resp.Rcode = dns.RcodeFormatError
+					return fmt.Errorf("bad cookie length: %v", len(cookie))
+				}
+				addr, ok := RemoteAddr(w)
+				if !ok {
+					break
+				}
+				respOpt := resp.IsEdns0()
+				respOpt.Option = append(respOpt.Option, &dns.EDNS0_COOKIE{
+					Code:   dns.EDNS0COOKIE,
+					Cookie: hex.EncodeToString(cookie[:clientCookieSize]) + hex.EncodeToString(cookies.Generate(cookie[:clientCookieSize], addr)),
+				})
+				if len(cookie) > clientCookieSize && GetProtocol(w) == ProtoUDP && !cookies.Valid(cookie, addr) {
+					resp.Rcode = dns.RcodeBadCookie
+					return ErrBadCookie
+				}
+				break
+			}
+		}
 	}
 	return nil
 }
@@ -102,7 +149,7 @@ func ResizeForTransport(req, resp *dns.Msg, proto string) {
 		if forceCompress {
 			resp.Compress = true
 		}
-	case ProtoTLS:
+	case ProtoTLS, ProtoHTTPS, ProtoQUIC:
 		if HasPadding(req) {
 			AddPadding(resp, ResponsePaddingBlockLength)
 		}
@@ -1,6 +1,7 @@
 package dnsutil
 
 import (
+	"context"
 	"crypto/tls"
 	"log"
 	"sync/atomic"
@@ -25,6 +26,12 @@ func MsgAcceptFunc(dh dns.Header) dns.MsgAcceptAction {
 	return dns.MsgAccept
 }
 
+// optionally implemented by a dns.ResponseWriter which may write a different message than given
+type MsgRewriter interface {
+	// gets the last message written
+	WrittenMsg() *dns.Msg
+}
+
 type LoggingResponseWriter struct {
 	dns.ResponseWriter
 	Start     time.Time
@@ -32,15 +39,24 @@ type LoggingResponseWriter struct {
 	AnCount   int
 	NsCount   int
 	ExCount   int
+	Msg       *dns.Msg // the response as written, if written
 	connState *tls.ConnectionState
 }
 
 func (w *LoggingResponseWriter) WriteMsg(m *dns.Msg) error {
+	err := w.ResponseWriter.WriteMsg(m)
+	if err == nil {
+		// e.g. truncated by rate limiting
+		if rw, ok := w.ResponseWriter.(MsgRewriter); ok {
+			m = rw.WrittenMsg()
+		}
+		w.Msg = m
+	}
 	w.Rcode = m.Rcode
 	w.AnCount = len(m.Answer)
 	w.NsCount = len(m.Ns)
 	w.ExCount = len(m.Extra)
-	return w.ResponseWriter.WriteMsg(m)
+	return err
 }
 
 func (w *LoggingResponseWriter) ConnectionState() *tls.ConnectionState {
@@ -50,8 +66,16 @@ func (w *LoggingResponseWriter) ConnectionState() *tls.ConnectionState {
 	return w.connState
 }
 
+func (w *LoggingResponseWriter) Context() context.Context {
+	return RequestContext(w.ResponseWriter)
+}
+
 type LoggingHandler struct {
 	Logger *log.Logger
+	JSON   bool // log JSON lines instead of text
+	Filter *RequestLogFilter
+	Zones  []string // served zones, for finding the zone of requests
+	Dnstap *DnstapLogger
 	Next   dns.Handler
 	count  atomic.Uint64
 }
@@ -67,11 +91,30 @@ func (h *LoggingHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	}
 	h.Next.ServeDNS(lw, req)
 	h.count.Add(1)
-	if h.Logger != nil {
+	zone := h.zone(req.Question[0].Name)
+	proto := GetProtocol(w)
+	rcode := "NONE"
+	if lw.Msg != nil {
+		rcode = dns.RcodeToString[lw.Rcode]
+	}
+	dnsResponses.With(zone, qtypeLabel(req.Question[0].Qtype), rcode, proto).Inc()
+	dnsRequestDuration.With(zone, proto).Observe(time.Since(lw.Start).Seconds())
+	if h.Dnstap != nil {
+		h.Dnstap.Log(lw, req, lw.Msg, lw.Start)
+	}
+	if h.Logger == nil {
+		return
+	}
+	if !h.Filter.Match(zone, lw.Rcode) {
+		return
+	}
+	if h.JSON {
+		h.logJSON(lw, req, zone)
+	} else {
 		h.Logger.Printf(
 			"%vms %s %s %s %s %s %s an:%v ns:%v ex:%v %s",
 			time.Since(lw.Start).Milliseconds(),
-			GetProtocol(w),
+			proto,
 			dns.RcodeToString[lw.Rcode],
 			dns.OpcodeToString[req.Opcode],
 			dns.Class(req.Question[0].Qclass),
@@ -84,3 +127,13 @@ func (h *LoggingHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		)
 	}
 }
+
+// gets the closest served zone containing name
+func (h *LoggingHandler) zone(name string) (zone string) {
+	for _, z := range h.Zones {
+		if len(z) > len(zone) && dns.IsSubDomain(z, name) {
+			zone = z
+		}
+	}
+	return
+}
@@ -0,0 +1,33 @@
+package dnsutil
+
+import (
+	"github.com/brianshea2/addr.tools/internal/metrics"
+	"github.com/miekg/dns"
+)
+
+var (
+	dnsResponses = metrics.NewCounterVec(
+		"addrd_dns_responses_total",
+		"DNS responses by zone, query type, rcode, and transport. Unsent responses have rcode NONE.",
+		"zone", "qtype", "rcode", "transport",
+	)
+	dnsRequestDuration = metrics.NewHistogramVec(
+		"addrd_dns_request_duration_seconds",
+		"DNS request handling latency by zone and transport.",
+		metrics.DefBuckets,
+		"zone", "transport",
+	)
+	dnssecSignatures = metrics.NewCounterVec(
+		"addrd_dnssec_signatures_total",
+		"DNSSEC signatures generated, excluding cached signatures, by signer.",
+		"signer",
+	)
+)
+
+// gets a metric label for qtype, limiting unknown types to one label
+func qtypeLabel(qtype uint16) string {
+	if s, ok := dns.TypeToString[qtype]; ok {
+		return s
+	}
+	return "OTHER"
+}
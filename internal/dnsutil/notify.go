@@ -0,0 +1,98 @@
+package dnsutil
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	NotifyDelay      = 5 * time.Second // debounces changes
+	NotifyTimeout    = 2 * time.Second
+	NotifyRetryDelay = 5 * time.Second // doubled after each attempt
+	NotifyRetries    = 5
+)
+
+// adds the default port to notify targets without one, finds the notify key's secret
+func (h *SimpleHandler) initNotify() error {
+	if len(h.NotifyTargets) > 0 && !h.transferEnabled() {
+		return fmt.Errorf("notify targets without a transfer ACL or keys")
+	}
+	for i, target := range h.NotifyTargets {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			if net.ParseIP(target) == nil {
+				return fmt.Errorf("invalid notify target: %v", target)
+			}
+			h.NotifyTargets[i] = net.JoinHostPort(target, "53")
+		}
+	}
+	if len(h.NotifyKey) > 0 {
+		h.NotifyKey = dns.CanonicalName(h.NotifyKey)
+		for name, secret := range h.TransferKeys {
+			if dns.CanonicalName(name) == h.NotifyKey {
+				h.notifySecret = secret
+				return nil
+			}
+		}
+		return fmt.Errorf("notify key is not a transfer key: %v", h.NotifyKey)
+	}
+	return nil
+}
+
+// signals that the zone's records may have changed. after a delay, the SOA serial is increased
+// and any secondaries are notified if they have. does nothing if transfers are disabled.
+func (h *SimpleHandler) Changed() {
+	if !h.transferEnabled() || !h.changePending.CompareAndSwap(false, true) {
+		return
+	}
+	time.AfterFunc(NotifyDelay, func() {
+		h.changePending.Store(false)
+		if _, _, err := h.refreshSerial(context.Background()); err != nil {
+			log.Printf("[error] SimpleHandler.refreshSerial (%v): %v", h.Zone, err)
+		}
+	})
+}
+
+// sends NOTIFY (rfc1996) for serial to each target
+func (h *SimpleHandler) notify(serial uint32) {
+	for _, target := range h.NotifyTargets {
+		go h.notifyTarget(target, serial)
+	}
+}
+
+// sends NOTIFY for serial to target until acknowledged, the retries run out, or the serial changes
+func (h *SimpleHandler) notifyTarget(target string, serial uint32) {
+	m := new(dns.Msg).SetNotify(h.Zone)
+	m.Authoritative = true
+	m.Answer = []dns.RR{h.soaRecord(h.Zone, serial)}
+	c := &dns.Client{Timeout: NotifyTimeout}
+	if len(h.NotifyKey) > 0 {
+		c.TsigSecret = map[string]string{h.NotifyKey: h.notifySecret}
+		m.SetTsig(h.NotifyKey, dns.HmacSHA256, TsigFudge, time.Now().Unix())
+	}
+	delay := NotifyRetryDelay
+	var err error
+	for i := 0; i < NotifyRetries; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+			delay *= 2
+			if st := h.soa.Load(); st == nil || st.serial != serial {
+				// superseded
+				return
+			}
+		}
+		var resp *dns.Msg
+		resp, _, err = c.Exchange(m, target)
+		if err == nil && resp.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("rcode %v", dns.RcodeToString[resp.Rcode])
+		}
+		if err == nil {
+			return
+		}
+	}
+	log.Printf("[warn] SimpleHandler.notify (%v): serial %v to %v: %v", h.Zone, serial, target, err)
+}
@@ -0,0 +1,158 @@
+package dnsutil
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// the maximum NSEC3 iterations, hashes are computed per query and rfc9276 recommends zero
+const Nsec3MaxIterations = 50
+
+var base32HexNoPad = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// NSEC3 parameters (rfc5155), rfc9276 recommends zero iterations, no salt
+type Nsec3Params struct {
+	Iterations uint16
+	Salt       string // hex
+	OptOut     bool
+}
+
+func (n *Nsec3Params) Validate() error {
+	if n.Iterations > Nsec3MaxIterations {
+		return fmt.Errorf("too many NSEC3 iterations: %v", n.Iterations)
+	}
+	b, err := hex.DecodeString(n.Salt)
+	if err != nil {
+		return fmt.Errorf("cannot decode NSEC3 salt: %w", err)
+	}
+	if len(b) > 255 {
+		return fmt.Errorf("NSEC3 salt too long: %v", len(b))
+	}
+	return nil
+}
+
+func (n *Nsec3Params) hash(name string) ([]byte, error) {
+	h, err := base32HexNoPad.DecodeString(dns.HashName(name, dns.SHA1, n.Iterations, n.Salt))
+	if err != nil || len(h) == 0 {
+		return nil, fmt.Errorf("cannot hash %v", name)
+	}
+	return h, nil
+}
+
+// adds d to hash h as a big-endian integer, wrapping around
+func addToHash(h []byte, d int) []byte {
+	out := make([]byte, len(h))
+	copy(out, h)
+	carry := d
+	for i := len(out) - 1; i >= 0 && carry != 0; i-- {
+		v := int(out[i]) + carry
+		out[i] = byte(v)
+		carry = v >> 8 // arithmetic shift keeps the sign when borrowing
+	}
+	return out
+}
+
+// gets an NSEC3 record at the hash owner, covering up to the hash next
+func (p *DnssecProvider) nsec3(owner, next []byte, types []uint16, n *Nsec3Params) *dns.NSEC3 {
+	var flags uint8
+	if n.OptOut {
+		flags = 1
+	}
+	return &dns.NSEC3{
+		Hdr: dns.RR_Header{
+			Name:   strings.ToLower(base32HexNoPad.EncodeToString(owner)) + "." + p.SigningKey.Hdr.Name,
+			Rrtype: dns.TypeNSEC3,
+			Class:  dns.ClassINET,
+			Ttl:    p.SigningKey.Hdr.Ttl,
+		},
+		Hash:       dns.SHA1,
+		Flags:      flags,
+		Iterations: n.Iterations,
+		SaltLength: uint8(len(n.Salt) / 2),
+		Salt:       strings.ToUpper(n.Salt),
+		HashLength: uint8(len(next)),
+		NextDomain: base32HexNoPad.EncodeToString(next),
+		TypeBitMap: types,
+	}
+}
+
+// gets an NSEC3 record matching name
+func (p *DnssecProvider) nsec3Matching(name string, types []uint16, n *Nsec3Params) (*dns.NSEC3, error) {
+	h, err := n.hash(name)
+	if err != nil {
+		return nil, err
+	}
+	return p.nsec3(h, addToHash(h, 1), types, n), nil
+}
+
+// gets an NSEC3 record minimally covering name
+func (p *DnssecProvider) nsec3Covering(name string, n *Nsec3Params) (*dns.NSEC3, error) {
+	h, err := n.hash(name)
+	if err != nil {
+		return nil, err
+	}
+	return p.nsec3(addToHash(h, -1), addToHash(h, 1), nil, n), nil
+}
+
+// gets the closest encloser claimed for a non-existent name, its parent within the zone
+func (p *DnssecProvider) nsec3Encloser(name string) string {
+	parent := p.SigningKey.Hdr.Name
+	if i, end := dns.NextLabel(name, 0); !end && len(name)-i >= len(parent) {
+		parent = name[i:]
+	}
+	return parent
+}
+
+// gets the NSEC3 records proving the non-existence of the name or type in q (rfc7129 appendix b).
+// existing lists the types of records at the query name, or at its closest encloser if nxdomain, if known.
+// the parent of a non-existent name is always claimed as its closest encloser, see nsec3Encloser.
+func (p *DnssecProvider) nsec3Proof(q *dns.Question, nxdomain bool, existing []uint16, n *Nsec3Params) ([]dns.RR, error) {
+	if !nxdomain {
+		// no data, matching NSEC3
+		rr, err := p.nsec3Matching(q.Name, p.typeBitMap(q.Name, q.Qtype, existing, true), n)
+		if err != nil {
+			return nil, err
+		}
+		return []dns.RR{rr}, nil
+	}
+	parent := p.nsec3Encloser(q.Name)
+	// closest encloser, matching NSEC3
+	encloser, err := p.nsec3Matching(parent, p.typeBitMap(parent, 0, existing, true), n)
+	if err != nil {
+		return nil, err
+	}
+	// next closer name, covering NSEC3
+	nextCloser, err := p.nsec3Covering(q.Name, n)
+	if err != nil {
+		return nil, err
+	}
+	// wildcard at closest encloser, covering NSEC3
+	wildcard, err := p.nsec3Covering("*."+parent, n)
+	if err != nil {
+		return nil, err
+	}
+	return []dns.RR{encloser, nextCloser, wildcard}, nil
+}
+
+// gets the apex NSEC3PARAM rrset, named name
+func (p *DnssecProvider) Nsec3Param(name string) []dns.RR {
+	if p == nil || p.SigningKey == nil || p.Nsec3 == nil {
+		return nil
+	}
+	return []dns.RR{&dns.NSEC3PARAM{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeNSEC3PARAM,
+			Class:  dns.ClassINET,
+			Ttl:    p.SigningKey.Hdr.Ttl,
+		},
+		Hash:       dns.SHA1,
+		Iterations: p.Nsec3.Iterations,
+		SaltLength: uint8(len(p.Nsec3.Salt) / 2),
+		Salt:       strings.ToUpper(p.Nsec3.Salt),
+	}}
+}
@@ -0,0 +1,86 @@
+package dnsutil
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newNsec3TestProvider(t *testing.T) *DnssecProvider {
+	t.Helper()
+	p, err := GenerateDnssecProvider("example.", dns.ECDSAP256SHA256, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Nsec3 = &Nsec3Params{}
+	return p
+}
+
+// proves resp to a DO query for name and qtype, returning the NSEC3 records added
+func proveNsec3(t *testing.T, p *DnssecProvider, name string, qtype uint16, rcode int, opts *ProofOptions) []*dns.NSEC3 {
+	t.Helper()
+	req := new(dns.Msg).SetQuestion(name, qtype)
+	req.SetEdns0(1232, true)
+	resp := new(dns.Msg).SetRcode(req, rcode)
+	opts.Nsec3 = p.Nsec3
+	if err := p.ProveWith(req, resp, 0, 0, opts); err != nil {
+		t.Fatal(err)
+	}
+	var rrs []*dns.NSEC3
+	for _, rr := range resp.Ns {
+		if nsec3, ok := rr.(*dns.NSEC3); ok {
+			rrs = append(rrs, nsec3)
+		}
+	}
+	return rrs
+}
+
+func TestNsec3ProofNodata(t *testing.T) {
+	p := newNsec3TestProvider(t)
+	rrs := proveNsec3(t, p, "a.example.", dns.TypeTXT, dns.RcodeSuccess, &ProofOptions{Types: []uint16{dns.TypeA}})
+	if len(rrs) != 1 {
+		t.Fatalf("got %v NSEC3 records, want 1", len(rrs))
+	}
+	if !rrs[0].Match("a.example.") {
+		t.Errorf("NSEC3 does not match the query name: %v", rrs[0])
+	}
+	if want := []uint16{dns.TypeA, dns.TypeRRSIG}; !slices.Equal(rrs[0].TypeBitMap, want) {
+		t.Errorf("got types %v, want %v", rrs[0].TypeBitMap, want)
+	}
+}
+
+func TestNsec3ProofNxdomain(t *testing.T) {
+	p := newNsec3TestProvider(t)
+	tests := []struct {
+		name     string
+		encloser string
+		existing []uint16
+		want     []uint16
+	}{
+		{"x.a.example.", "a.example.", []uint16{dns.TypeTXT}, []uint16{dns.TypeTXT, dns.TypeRRSIG}},
+		{"x.a.example.", "a.example.", []uint16{}, []uint16{dns.TypeRRSIG}},
+		{"b.example.", "example.", []uint16{dns.TypeSOA, dns.TypeNS}, []uint16{
+			dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM,
+		}},
+	}
+	for _, tt := range tests {
+		rrs := proveNsec3(t, p, tt.name, dns.TypeA, dns.RcodeNameError, &ProofOptions{EncloserTypes: tt.existing})
+		if len(rrs) != 3 {
+			t.Fatalf("%v: got %v NSEC3 records, want 3", tt.name, len(rrs))
+		}
+		encloser, nextCloser, wildcard := rrs[0], rrs[1], rrs[2]
+		if !encloser.Match(tt.encloser) {
+			t.Errorf("%v: NSEC3 does not match the closest encloser: %v", tt.name, encloser)
+		}
+		if !slices.Equal(encloser.TypeBitMap, tt.want) {
+			t.Errorf("%v: got closest encloser types %v, want %v", tt.name, encloser.TypeBitMap, tt.want)
+		}
+		if !nextCloser.Cover(tt.name) || nextCloser.Match(tt.name) {
+			t.Errorf("%v: NSEC3 does not cover the next closer name: %v", tt.name, nextCloser)
+		}
+		if !wildcard.Cover("*."+tt.encloser) || wildcard.Match("*."+tt.encloser) {
+			t.Errorf("%v: NSEC3 does not cover the wildcard: %v", tt.name, wildcard)
+		}
+	}
+}
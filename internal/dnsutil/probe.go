@@ -0,0 +1,28 @@
+package dnsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// checks that a server on network ("udp", "tcp", "tcp-tls", or "quic") at addr answers the SOA of zone
+func Probe(ctx context.Context, network, addr, zone string, tlsConfig *tls.Config) error {
+	req := new(dns.Msg).SetQuestion(zone, dns.TypeSOA)
+	var resp *dns.Msg
+	var err error
+	if network == "quic" {
+		resp, err = DoqExchange(ctx, req, addr, tlsConfig)
+	} else {
+		resp, _, err = (&dns.Client{Net: network, TLSConfig: tlsConfig}).ExchangeContext(ctx, req, addr)
+	}
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) == 0 {
+		return fmt.Errorf("unexpected response: %v", dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
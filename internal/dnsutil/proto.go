@@ -1,15 +1,20 @@
 package dnsutil
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"net/netip"
 
 	"github.com/miekg/dns"
 )
 
 const (
-	ProtoUDP = "UDP"
-	ProtoTCP = "TCP"
-	ProtoTLS = "TLS"
+	ProtoUDP   = "UDP"
+	ProtoTCP   = "TCP"
+	ProtoTLS   = "TLS"
+	ProtoHTTPS = "HTTPS"
+	ProtoQUIC  = "QUIC"
 )
 
 func GetProtocol(w dns.ResponseWriter) string {
@@ -21,6 +26,52 @@ func GetProtocol(w dns.ResponseWriter) string {
 			return ProtoTLS
 		}
 		return ProtoTCP
+	case *DohAddr:
+		return ProtoHTTPS
+	case *DoqAddr:
+		return ProtoQUIC
 	}
 	return ""
 }
+
+// optionally implemented by a dns.ResponseWriter whose request is canceled if the client goes away
+type RequestContexter interface {
+	Context() context.Context
+}
+
+// gets the context of the request answered by w
+func RequestContext(w dns.ResponseWriter) context.Context {
+	if c, ok := w.(RequestContexter); ok {
+		return c.Context()
+	}
+	return context.Background()
+}
+
+// gets the unmapped address of the client
+func RemoteAddr(w dns.ResponseWriter) (addr netip.Addr, ok bool) {
+	var ip net.IP
+	switch a := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	addr, ok = netip.AddrFromSlice(ip)
+	return addr.Unmap(), ok
+}
+
+// parses addresses or networks
+func ParsePrefixes(ss []string) (prefixes []netip.Prefix, err error) {
+	for _, s := range ss {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address or network: %v", s)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return
+}
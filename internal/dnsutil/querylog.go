@@ -0,0 +1,125 @@
+package dnsutil
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// selects the requests logged by a LoggingHandler
+type RequestLogFilter struct {
+	SampleRate float64  // fraction of requests logged, 0 logs all
+	Zones      []string // if not empty, only requests in these zones are logged
+	Rcodes     []string // if not empty, only responses with these rcodes are logged, e.g. "SERVFAIL"
+}
+
+func (f *RequestLogFilter) Init() error {
+	if f.SampleRate < 0 || f.SampleRate > 1 {
+		return fmt.Errorf("invalid request log sample rate: %v", f.SampleRate)
+	}
+	for i, zone := range f.Zones {
+		f.Zones[i] = ToLowerAscii(dns.CanonicalName(zone))
+	}
+	for _, rcode := range f.Rcodes {
+		if _, ok := dns.StringToRcode[rcode]; !ok {
+			return fmt.Errorf("invalid request log rcode: %v", rcode)
+		}
+	}
+	return nil
+}
+
+// checks if a request in zone with response rcode should be logged
+func (f *RequestLogFilter) Match(zone string, rcode int) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Zones) > 0 && !containsFold(f.Zones, zone) {
+		return false
+	}
+	if len(f.Rcodes) > 0 && !containsFold(f.Rcodes, dns.RcodeToString[rcode]) {
+		return false
+	}
+	return f.SampleRate == 0 || rand.Float64() < f.SampleRate
+}
+
+func containsFold(ss []string, s string) bool {
+	for _, v := range ss {
+		if EqualsAsciiIgnoreCase(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+type requestLogEntry struct {
+	Time       time.Time `json:"time"`
+	Zone       string    `json:"zone,omitempty"`
+	Qname      string    `json:"qname"`
+	Qtype      string    `json:"qtype"`
+	Qclass     string    `json:"qclass"`
+	Opcode     string    `json:"opcode"`
+	Rcode      string    `json:"rcode"`
+	RD         bool      `json:"rd"`
+	CD         bool      `json:"cd"`
+	DO         bool      `json:"do"`
+	EdnsSize   uint16    `json:"edns_size,omitempty"`
+	ECS        string    `json:"ecs,omitempty"`
+	Transport  string    `json:"transport"`
+	TLSVersion string    `json:"tls_version,omitempty"`
+	Client     string    `json:"client"`
+	LatencyUs  int64     `json:"latency_us"`
+	Size       int       `json:"size"`
+	AnCount    int       `json:"an"`
+	NsCount    int       `json:"ns"`
+	ExCount    int       `json:"ex"`
+}
+
+// logs the request and response as a JSON line
+func (h *LoggingHandler) logJSON(lw *LoggingResponseWriter, req *dns.Msg, zone string) {
+	q := &req.Question[0]
+	proto := GetProtocol(lw)
+	entry := &requestLogEntry{
+		Time:      lw.Start,
+		Zone:      zone,
+		Qname:     q.Name,
+		Qtype:     dns.Type(q.Qtype).String(),
+		Qclass:    dns.Class(q.Qclass).String(),
+		Opcode:    dns.OpcodeToString[req.Opcode],
+		Rcode:     dns.RcodeToString[lw.Rcode],
+		RD:        req.RecursionDesired,
+		CD:        req.CheckingDisabled,
+		Transport: proto,
+		Client:    lw.RemoteAddr().String(),
+		LatencyUs: time.Since(lw.Start).Microseconds(),
+		AnCount:   lw.AnCount,
+		NsCount:   lw.NsCount,
+		ExCount:   lw.ExCount,
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		entry.DO = opt.Do()
+		entry.EdnsSize = opt.UDPSize()
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+				entry.ECS = fmt.Sprintf("%v/%v", subnet.Address, subnet.SourceNetmask)
+				break
+			}
+		}
+	}
+	if proto == ProtoTLS || proto == ProtoQUIC {
+		if cs := lw.ConnectionState(); cs != nil {
+			entry.TLSVersion = tls.VersionName(cs.Version)
+		}
+	}
+	if lw.Msg != nil {
+		entry.Size = lw.Msg.Len()
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	h.Logger.Print(string(b))
+}
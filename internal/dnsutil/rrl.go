@@ -0,0 +1,244 @@
+package dnsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// response classes, limited separately
+const (
+	rrlAnswer   = "answer"
+	rrlNodata   = "nodata"
+	rrlNxdomain = "nxdomain"
+	rrlError    = "error"
+)
+
+var ErrRateLimited = errors.New("response dropped by rate limiting")
+
+type rrlEntry struct {
+	balance int   // responses remaining in the current second, negative when limited
+	last    int64 // unix time of the last response
+	limited int   // responses limited since last allowed
+}
+
+// limits identical udp responses to client networks (BIND-style response rate limiting).
+// limited responses are dropped, or truncated every Slip responses, prompting honest clients to retry over tcp.
+type RateLimitingHandler struct {
+	Next               dns.Handler
+	ResponsesPerSecond int
+	Window             int            // seconds of excess responses remembered, default 15
+	Slip               int            // every nth limited response is truncated, default 2, negative drops all
+	IPv4PrefixLen      int            // default 24
+	IPv6PrefixLen      int            // default 56
+	Exempt             []string       // addresses or networks never limited
+	Cookies            *ServerCookies // requests with valid server cookies are never limited
+	MaxSize            int            // maximum tracked responses, 0 is unlimited
+	Logger             *log.Logger    // optionally logs newly limited responses
+	exemptNets         []netip.Prefix
+	mu                 sync.Mutex
+	m                  map[string]*rrlEntry
+	dropped            atomic.Uint64
+	truncated          atomic.Uint64
+}
+
+func (h *RateLimitingHandler) Init() *RateLimitingHandler {
+	if h.ResponsesPerSecond <= 0 {
+		log.Fatal("invalid rate limit responses per second")
+	}
+	if h.Window <= 0 {
+		h.Window = 15
+	}
+	if h.Slip == 0 {
+		h.Slip = 2
+	}
+	if h.IPv4PrefixLen <= 0 || h.IPv4PrefixLen > 32 {
+		h.IPv4PrefixLen = 24
+	}
+	if h.IPv6PrefixLen <= 0 || h.IPv6PrefixLen > 128 {
+		h.IPv6PrefixLen = 56
+	}
+	nets, err := ParsePrefixes(h.Exempt)
+	if err != nil {
+		log.Fatal(err)
+	}
+	h.exemptNets = nets
+	h.m = make(map[string]*rrlEntry)
+	return h
+}
+
+func (h *RateLimitingHandler) Size() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.m)
+}
+
+func (h *RateLimitingHandler) Dropped() uint64 {
+	return h.dropped.Load()
+}
+
+func (h *RateLimitingHandler) Truncated() uint64 {
+	return h.truncated.Load()
+}
+
+// forgets responses not limited within the window
+func (h *RateLimitingHandler) Prune() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now().Unix()
+	for key, e := range h.m {
+		if now-e.last > int64(h.Window) {
+			delete(h.m, key)
+		}
+	}
+}
+
+func (h *RateLimitingHandler) PrunePeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		h.Prune()
+	}
+}
+
+// gets the response class and the name it is limited by
+func rrlClass(resp *dns.Msg) (class, name string) {
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+		if len(resp.Answer) > 0 {
+			return rrlAnswer, resp.Question[0].Name + " " + dns.Type(resp.Question[0].Qtype).String()
+		}
+		class = rrlNodata
+	case dns.RcodeNameError:
+		class = rrlNxdomain
+	default:
+		return rrlError, ""
+	}
+	// negative responses are limited by zone, so random names don't evade the limit
+	for _, rr := range resp.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return class, rr.Header().Name
+		}
+	}
+	return class, resp.Question[0].Name
+}
+
+// checks if a response to network should be sent, or if a limited response should be truncated
+func (h *RateLimitingHandler) allow(network netip.Prefix, resp *dns.Msg) (allow, truncate bool) {
+	class, name := rrlClass(resp)
+	key := network.String() + " " + class + " " + ToLowerAscii(name)
+	now := time.Now().Unix()
+	h.mu.Lock()
+	e := h.m[key]
+	if e == nil {
+		if h.MaxSize > 0 && len(h.m) >= h.MaxSize {
+			// evict an arbitrary entry
+			for k := range h.m {
+				delete(h.m, k)
+				break
+			}
+		}
+		e = &rrlEntry{balance: h.ResponsesPerSecond, last: now}
+		h.m[key] = e
+	}
+	if elapsed := now - e.last; elapsed > 0 {
+		e.balance = min(e.balance+int(elapsed)*h.ResponsesPerSecond, h.ResponsesPerSecond)
+		e.last = now
+	}
+	e.balance = max(e.balance-1, -h.Window*h.ResponsesPerSecond)
+	if e.balance >= 0 {
+		e.limited = 0
+		h.mu.Unlock()
+		return true, false
+	}
+	e.limited++
+	limited := e.limited
+	h.mu.Unlock()
+	if limited == 1 && h.Logger != nil {
+		h.Logger.Printf("limiting %s %s %s", network, class, name)
+	}
+	return false, h.Slip > 0 && limited%h.Slip == 0
+}
+
+type rateLimitingResponseWriter struct {
+	dns.ResponseWriter
+	h       *RateLimitingHandler
+	network netip.Prefix
+	written *dns.Msg
+}
+
+func (w *rateLimitingResponseWriter) WriteMsg(m *dns.Msg) error {
+	if len(m.Question) == 0 {
+		return w.write(m)
+	}
+	allow, truncate := w.h.allow(w.network, m)
+	if allow {
+		return w.write(m)
+	}
+	if !truncate {
+		w.h.dropped.Add(1)
+		return ErrRateLimited
+	}
+	w.h.truncated.Add(1)
+	tc := new(dns.Msg)
+	tc.MsgHdr = m.MsgHdr
+	tc.Truncated = true
+	tc.Question = m.Question
+	if opt := m.IsEdns0(); opt != nil {
+		tc.Extra = []dns.RR{opt}
+	}
+	return w.write(tc)
+}
+
+func (w *rateLimitingResponseWriter) write(m *dns.Msg) error {
+	w.written = m
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func (w *rateLimitingResponseWriter) WrittenMsg() *dns.Msg {
+	return w.written
+}
+
+func (w *rateLimitingResponseWriter) ConnectionState() *tls.ConnectionState {
+	return w.ResponseWriter.(dns.ConnectionStater).ConnectionState()
+}
+
+func (w *rateLimitingResponseWriter) Context() context.Context {
+	return RequestContext(w.ResponseWriter)
+}
+
+func (h *RateLimitingHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	// only udp sources can be spoofed
+	if GetProtocol(w) != ProtoUDP {
+		h.Next.ServeDNS(w, req)
+		return
+	}
+	addr, ok := RemoteAddr(w)
+	if !ok {
+		h.Next.ServeDNS(w, req)
+		return
+	}
+	for _, prefix := range h.exemptNets {
+		if prefix.Contains(addr) {
+			h.Next.ServeDNS(w, req)
+			return
+		}
+	}
+	// the client address of a valid server cookie isn't spoofed
+	if h.Cookies != nil && hasValidCookie(req, addr, h.Cookies) {
+		h.Next.ServeDNS(w, req)
+		return
+	}
+	bits := h.IPv6PrefixLen
+	if addr.Is4() {
+		bits = h.IPv4PrefixLen
+	}
+	network, _ := addr.Prefix(bits)
+	h.Next.ServeDNS(&rateLimitingResponseWriter{ResponseWriter: w, h: h, network: network}, req)
+}
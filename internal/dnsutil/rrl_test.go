@@ -0,0 +1,50 @@
+package dnsutil
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func rrlResponse(name string, rcode int) *dns.Msg {
+	resp := new(dns.Msg).SetRcode(new(dns.Msg).SetQuestion(name, dns.TypeA), rcode)
+	if rcode == dns.RcodeNameError {
+		resp.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET}}}
+	}
+	return resp
+}
+
+func TestRateLimitingHandlerAllow(t *testing.T) {
+	network := netip.MustParsePrefix("192.0.2.0/24")
+	other := netip.MustParsePrefix("198.51.100.0/24")
+	// allowed, allowed, dropped, truncated, dropped, truncated
+	wantAllow := []bool{true, true, false, false, false, false}
+	wantTruncate := []bool{false, false, false, true, false, true}
+	// the balance is refilled each second
+	for attempt := 0; attempt < 3; attempt++ {
+		h := (&RateLimitingHandler{ResponsesPerSecond: 2, Slip: 2}).Init()
+		start := time.Now().Unix()
+		var allow, truncate [6]bool
+		for i := range allow {
+			// nxdomain responses for different names in a zone share a limit
+			allow[i], truncate[i] = h.allow(network, rrlResponse(string(rune('a'+i))+".example.", dns.RcodeNameError))
+		}
+		otherAllow, _ := h.allow(other, rrlResponse("a.example.", dns.RcodeNameError))
+		if time.Now().Unix() != start {
+			continue
+		}
+		for i := range allow {
+			if allow[i] != wantAllow[i] || truncate[i] != wantTruncate[i] {
+				t.Errorf("response %v: got allow %v truncate %v, want %v %v",
+					i+1, allow[i], truncate[i], wantAllow[i], wantTruncate[i])
+			}
+		}
+		if !otherAllow {
+			t.Error("response to another network limited")
+		}
+		return
+	}
+	t.Skip("second boundary crossed on every attempt")
+}
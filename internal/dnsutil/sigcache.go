@@ -0,0 +1,102 @@
+package dnsutil
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// cached signatures are refreshed this many seconds (plus the rrset ttl) before they expire
+const SigCacheRefreshWindow = 900
+
+type sigCacheEntry struct {
+	sigs      []*dns.RRSIG
+	refreshAt uint32
+}
+
+// a bounded cache of rrset signatures, safe to share between DnssecProviders
+type SigCache struct {
+	MaxSize int
+	mu      sync.RWMutex
+	m       map[string]*sigCacheEntry
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+}
+
+// gets the cache key of a canonical rrset signed by keys
+func sigCacheKey(rrset []dns.RR, keys []*dns.DNSKEY) string {
+	hdr := rrset[0].Header()
+	rdatas := make([]string, len(rrset))
+	for i, rr := range rrset {
+		rdatas[i] = strings.TrimPrefix(rr.String(), rr.Header().String())
+	}
+	slices.Sort(rdatas)
+	var b strings.Builder
+	b.WriteString(ToLowerAscii(hdr.Name))
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatUint(uint64(hdr.Rrtype), 10))
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatUint(uint64(hdr.Ttl), 10))
+	for _, key := range keys {
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatUint(uint64(key.KeyTag()), 10))
+	}
+	for _, rdata := range rdatas {
+		b.WriteByte('\n')
+		b.WriteString(rdata)
+	}
+	return b.String()
+}
+
+// gets copies of cached signatures for key, named name, if not due for refresh at now
+func (c *SigCache) get(key, name string, now uint32) []dns.RR {
+	c.mu.RLock()
+	e := c.m[key]
+	c.mu.RUnlock()
+	if e == nil || now >= e.refreshAt {
+		c.misses.Add(1)
+		return nil
+	}
+	c.hits.Add(1)
+	sigs := make([]dns.RR, len(e.sigs))
+	for i, sig := range e.sigs {
+		cp := *sig
+		cp.Hdr.Name = name
+		sigs[i] = &cp
+	}
+	return sigs
+}
+
+func (c *SigCache) set(key string, sigs []*dns.RRSIG, refreshAt uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]*sigCacheEntry)
+	}
+	if _, exists := c.m[key]; !exists && c.MaxSize > 0 && len(c.m) >= c.MaxSize {
+		// evict an arbitrary entry
+		for k := range c.m {
+			delete(c.m, k)
+			break
+		}
+	}
+	c.m[key] = &sigCacheEntry{sigs, refreshAt}
+}
+
+func (c *SigCache) Size() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.m)
+}
+
+func (c *SigCache) Hits() uint64 {
+	return c.hits.Load()
+}
+
+func (c *SigCache) Misses() uint64 {
+	return c.misses.Load()
+}
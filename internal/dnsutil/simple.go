@@ -1,18 +1,37 @@
 package dnsutil
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
+	"net/netip"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+// minimum remaining validity of SOA signatures, which are refreshed long before
+const SoaSigExpiryMargin = time.Hour
+
+const DefaultLookupTimeout = 300 * time.Millisecond
+
 type RecordGenerator interface {
-	GenerateRecords(question *dns.Question, zone string) (rrs []dns.RR, validName bool, err error)
+	// gets the records answering question, ctx is canceled when the answer is no longer useful
+	GenerateRecords(ctx context.Context, question *dns.Question, zone string) (rrs []dns.RR, validName bool, err error)
+}
+
+// optionally implemented by a RecordGenerator to list the types of records at a valid name,
+// allowing accurate NSEC type bitmaps (rfc8198)
+type TypeLister interface {
+	ListTypes(ctx context.Context, name, zone string) (types []uint16, err error)
 }
 
+// serves a zone of generated and static records.
+// the SOA serial only tracks changes when transfers are enabled, otherwise it is always 1.
 type SimpleHandler struct {
 	RecordGenerator
 	*DnssecProvider
@@ -20,31 +39,79 @@ type SimpleHandler struct {
 	Ns             []string
 	HostMasterMbox string
 	StaticRecords  StaticRecords
-	soaSig         atomic.Pointer[dns.RRSIG]
+	Timers         ZoneTimers
+	Cookies        *ServerCookies
+	Nsid           string            // server identity returned to clients requesting it (rfc5001)
+	TransferACL    []string          // addresses or networks allowed to transfer the zone, serials are per instance, not for signed zones
+	TransferKeys   map[string]string // TSIG keys allowed to transfer the zone, name to base64 secret
+	NotifyTargets  []string          // secondaries to notify of changes, addresses with optional ports
+	NotifyKey      string            // optional name of the transfer key to sign notifications with
+	LookupTimeout  int               // milliseconds allowed to generate the records of a query, default 300
+	TsigKeys       *TsigMux          // updates signed by its static keys, i.e. any zone's transfer keys, are refused
+	transferNets   []netip.Prefix
+	notifySecret   string
+	changePending  atomic.Bool
+	soaMu          sync.Mutex
+	soa            atomic.Pointer[soaState]
+	zoneHash       uint64
 }
 
-func (h *SimpleHandler) initSoaSig() {
-	soa := h.SOA(nil, false)
-	ttl := soa[0].Header().Ttl
-	now := uint32(time.Now().Unix())
-	sigs, err := h.DnssecProvider.Sign(soa, now-3600, now+3600+2*ttl)
-	if err != nil {
-		log.Fatal(err)
+// the current SOA serial and signatures
+type soaState struct {
+	serial uint32
+	sigs   []dns.RR
+}
+
+// sets the SOA serial, signing the SOA if needed
+func (h *SimpleHandler) setSerial(serial uint32) error {
+	st := &soaState{serial: serial}
+	if h.DnssecProvider != nil {
+		soa := h.soaRecord(h.Zone, serial)
+		now := uint32(time.Now().Unix())
+		sigs, err := h.DnssecProvider.Sign([]dns.RR{soa}, now-3600, now+3600+2*soa.Hdr.Ttl)
+		if err != nil {
+			return err
+		}
+		st.sigs = sigs
 	}
-	h.soaSig.Store(sigs[0].(*dns.RRSIG))
+	h.soa.Store(st)
+	return nil
+}
+
+func (h *SimpleHandler) initSoaSig() {
+	ttl := h.soaRecord(h.Zone, 0).Hdr.Ttl
 	go func() {
 		for {
 			time.Sleep(time.Duration(rand.Int63n(int64(ttl/2))+int64(ttl/2)) * time.Second)
-			now = uint32(time.Now().Unix())
-			sigs, err = h.DnssecProvider.Sign(soa, now-3600, now+3600+2*ttl)
+			h.soaMu.Lock()
+			err := h.setSerial(h.soa.Load().serial)
+			h.soaMu.Unlock()
 			if err != nil {
 				log.Fatal(err)
 			}
-			h.soaSig.Store(sigs[0].(*dns.RRSIG))
 		}
 	}()
 }
 
+// checks that the SOA signatures are being refreshed
+func (h *SimpleHandler) CheckSoaSigs(ctx context.Context) error {
+	st := h.soa.Load()
+	if st == nil {
+		return errors.New("not initialized")
+	}
+	if h.DnssecProvider != nil && len(st.sigs) == 0 {
+		return errors.New("SOA not signed")
+	}
+	now := uint32(time.Now().Unix())
+	for _, rr := range st.sigs {
+		sig := rr.(*dns.RRSIG)
+		if remaining := time.Duration(int32(sig.Expiration-now)) * time.Second; remaining < SoaSigExpiryMargin {
+			return fmt.Errorf("SOA signature by key %v expires in %v", sig.KeyTag, remaining)
+		}
+	}
+	return nil
+}
+
 func (h *SimpleHandler) Init(privKeyBytes []byte) *SimpleHandler {
 	h.Zone = dns.CanonicalName(h.Zone)
 	for i, ns := range h.Ns {
@@ -55,22 +122,49 @@ func (h *SimpleHandler) Init(privKeyBytes []byte) *SimpleHandler {
 	} else {
 		h.HostMasterMbox = dns.CanonicalName(h.HostMasterMbox)
 	}
+	h.Timers.SetDefaults()
 	if h.DnssecProvider != nil {
-		h.DnssecProvider.SigningKey.Hdr.Name = h.Zone
-		h.DnssecProvider.SigningKey.Hdr.Rrtype = dns.TypeDNSKEY
-		h.DnssecProvider.SigningKey.Hdr.Class = dns.ClassINET
-		h.DnssecProvider.SigningKey.Hdr.Ttl = 1800
-		h.DnssecProvider.SigningKey.Flags = 257  // Secure Entry Point
-		h.DnssecProvider.SigningKey.Protocol = 3 // DNSSEC
-		err := h.DnssecProvider.SetPrivKeyBytes(privKeyBytes)
+		err := h.DnssecProvider.Init(h.Zone, 1800, privKeyBytes)
 		if err != nil {
 			log.Fatal(err)
 		}
+	}
+	err := h.initNotify()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = h.initTransfer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = h.initSerial()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if h.DnssecProvider != nil {
 		h.initSoaSig()
 	}
 	return h
 }
 
+func (h *SimpleHandler) soaRecord(name string, serial uint32) *dns.SOA {
+	return h.Timers.SOA(name, h.Ns[0], h.HostMasterMbox, serial)
+}
+
+func (h *SimpleHandler) lookupTimeout() time.Duration {
+	if h.LookupTimeout <= 0 {
+		return DefaultLookupTimeout
+	}
+	return time.Duration(h.LookupTimeout) * time.Millisecond
+}
+
+// gets records generated for q with the configured ttls
+func (h *SimpleHandler) generateRecords(ctx context.Context, q *dns.Question) (rrs []dns.RR, validName bool, err error) {
+	rrs, validName, err = h.GenerateRecords(ctx, q, h.Zone)
+	h.Timers.ApplyTtls(rrs)
+	return
+}
+
 func (h *SimpleHandler) SOA(q *dns.Question, includeSig bool) (rrs []dns.RR) {
 	var name string
 	if q == nil {
@@ -78,43 +172,59 @@ func (h *SimpleHandler) SOA(q *dns.Question, includeSig bool) (rrs []dns.RR) {
 	} else {
 		name = q.Name[len(q.Name)-len(h.Zone):]
 	}
-	if includeSig {
-		rrs = make([]dns.RR, 1, 2)
-	} else {
-		rrs = make([]dns.RR, 1)
-	}
-	rrs[0] = &dns.SOA{
-		Hdr: dns.RR_Header{
-			Name:   name,
-			Rrtype: dns.TypeSOA,
-			Class:  dns.ClassINET,
-			Ttl:    1800,
-		},
-		Ns:      h.Ns[0],
-		Mbox:    h.HostMasterMbox,
-		Serial:  1,
-		Refresh: 1800,
-		Retry:   1800,
-		Expire:  3600,
-		Minttl:  1800,
-	}
+	st := h.soa.Load()
+	rrs = make([]dns.RR, 1)
+	rrs[0] = h.soaRecord(name, st.serial)
 	if !includeSig {
 		return
 	}
-	if sig := h.soaSig.Load(); sig != nil {
+	for _, sig := range st.sigs {
 		rrs = append(rrs, dns.Copy(sig))
-		rrs[1].Header().Name = name
+		rrs[len(rrs)-1].Header().Name = name
 	}
 	return
 }
 
+// gets the types of records at name, or nil if unknown
+func (h *SimpleHandler) listTypes(ctx context.Context, name string) ([]uint16, error) {
+	lister, ok := h.RecordGenerator.(TypeLister)
+	if !ok {
+		return nil, nil
+	}
+	types, err := lister.ListTypes(ctx, name, h.Zone)
+	if err != nil {
+		return nil, err
+	}
+	types = append(types, h.StaticRecords.Types(name)...)
+	if len(name) == len(h.Zone) {
+		types = append(types, dns.TypeSOA, dns.TypeNS)
+	}
+	if types == nil {
+		types = []uint16{}
+	}
+	return types, nil
+}
+
 func (h *SimpleHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
-	// queries only
-	if req.Opcode != dns.OpcodeQuery {
+	// queries and updates only
+	switch req.Opcode {
+	case dns.OpcodeQuery:
+		switch req.Question[0].Qtype {
+		case dns.TypeAXFR, dns.TypeIXFR:
+			h.serveTransfer(w, req)
+			return
+		}
+	case dns.OpcodeUpdate:
+		h.serveUpdate(w, req)
+		return
+	default:
 		w.WriteMsg(new(dns.Msg).SetRcode(req, dns.RcodeNotImplemented))
 		return
 	}
 	q := &req.Question[0]
+	// limit record generation, the client retries or gives up soon after
+	ctx, cancel := context.WithTimeout(RequestContext(w), h.lookupTimeout())
+	defer cancel()
 	// prepare response, defer send
 	resp := new(dns.Msg).SetReply(req)
 	resp.Authoritative = true
@@ -122,7 +232,7 @@ func (h *SimpleHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		w.WriteMsg(resp)
 	}()
 	// edns
-	err := CheckAndSetEdns(req, resp)
+	err := CheckAndSetEdns(w, req, resp, h.Cookies, h.Nsid)
 	if err != nil {
 		// Rcode already set by CheckAndSetEdns
 		return
@@ -137,7 +247,7 @@ func (h *SimpleHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	case dns.TypeOPT, dns.TypeNXNAME:
 		resp.Rcode = dns.RcodeFormatError
 		return
-	case dns.TypeRRSIG, dns.TypeNSEC:
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
 		resp.Rcode = dns.RcodeRefused
 		return
 	case dns.TypeANY:
@@ -155,7 +265,26 @@ func (h *SimpleHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	}()
 	// defer dnssec proof
 	defer func() {
-		err := h.Prove(req, resp, 0, 0)
+		if h.DnssecProvider == nil {
+			return
+		}
+		opts := &ProofOptions{Nsec3: h.Nsec3}
+		if opt := req.IsEdns0(); opt != nil && opt.Do() {
+			if resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0 {
+				types, err := h.listTypes(ctx, q.Name)
+				if err != nil {
+					log.Printf("[error] SimpleHandler.listTypes (%v): %v", h.Zone, err)
+				}
+				opts.Types = types
+			} else if resp.Rcode == dns.RcodeNameError && h.Nsec3 != nil {
+				types, err := h.listTypes(ctx, h.nsec3Encloser(q.Name))
+				if err != nil {
+					log.Printf("[error] SimpleHandler.listTypes (%v): %v", h.Zone, err)
+				}
+				opts.EncloserTypes = types
+			}
+		}
+		err := h.ProveWith(req, resp, 0, 0, opts)
 		if err != nil {
 			log.Printf("[error] DnssecProvider.Prove: %v", err)
 			resp = new(dns.Msg).SetRcode(req, dns.RcodeServerFailure)
@@ -197,17 +326,17 @@ func (h *SimpleHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 			opt := req.IsEdns0()
 			resp.Answer = append(resp.Answer, h.SOA(q, opt != nil && opt.Do())...)
 		case dns.TypeNS:
-			for _, ns := range h.Ns {
-				resp.Answer = append(resp.Answer, &dns.NS{
-					Hdr: dns.RR_Header{
-						Name:   q.Name,
-						Rrtype: dns.TypeNS,
-						Class:  dns.ClassINET,
-						Ttl:    1800,
-					},
-					Ns: ns,
-				})
+			resp.Answer = append(resp.Answer, h.Timers.NS(q.Name, h.Ns)...)
+		case dns.TypeCDS, dns.TypeCDNSKEY:
+			rrs, err := h.DnssecProvider.Cds(q.Name, q.Qtype)
+			if err != nil {
+				log.Printf("[error] SimpleHandler.ServeDNS (%v): DnssecProvider.Cds: %v", h.Zone, err)
+				resp = new(dns.Msg).SetRcode(req, dns.RcodeServerFailure)
+				return
 			}
+			resp.Answer = append(resp.Answer, rrs...)
+		case dns.TypeNSEC3PARAM:
+			resp.Answer = append(resp.Answer, h.DnssecProvider.Nsec3Param(q.Name)...)
 		}
 	}
 	// static records
@@ -222,7 +351,7 @@ func (h *SimpleHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	}
 	// generate records
 	if h.RecordGenerator != nil {
-		rrs, validName, err := h.GenerateRecords(q, h.Zone)
+		rrs, validName, err := h.generateRecords(ctx, q)
 		if err != nil {
 			log.Printf("[error] SimpleHandler.GenerateRecords (%v): %v", h.Zone, err)
 			resp = new(dns.Msg).SetRcode(req, dns.RcodeServerFailure)
@@ -0,0 +1,83 @@
+package dnsutil
+
+import "github.com/miekg/dns"
+
+// SOA timers and record ttls in seconds, zero values use the defaults
+type ZoneTimers struct {
+	Refresh    uint32 // default 1800
+	Retry      uint32 // default 1800
+	Expire     uint32 // default 3600
+	Minttl     uint32 // default 1800, also the SOA ttl
+	NsTtl      uint32 // default 1800
+	AddressTtl uint32 // generated A and AAAA records, default set by the generator
+	TxtTtl     uint32 // generated TXT records, default set by the generator
+}
+
+func (t *ZoneTimers) SetDefaults() {
+	if t.Refresh == 0 {
+		t.Refresh = 1800
+	}
+	if t.Retry == 0 {
+		t.Retry = 1800
+	}
+	if t.Expire == 0 {
+		t.Expire = 3600
+	}
+	if t.Minttl == 0 {
+		t.Minttl = 1800
+	}
+	if t.NsTtl == 0 {
+		t.NsTtl = 1800
+	}
+}
+
+func (t *ZoneTimers) SOA(name, ns, mbox string, serial uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    t.Minttl,
+		},
+		Ns:      ns,
+		Mbox:    mbox,
+		Serial:  serial,
+		Refresh: t.Refresh,
+		Retry:   t.Retry,
+		Expire:  t.Expire,
+		Minttl:  t.Minttl,
+	}
+}
+
+// gets the NS records for nameservers, named name
+func (t *ZoneTimers) NS(name string, nameservers []string) (rrs []dns.RR) {
+	for _, ns := range nameservers {
+		rrs = append(rrs, &dns.NS{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeNS,
+				Class:  dns.ClassINET,
+				Ttl:    t.NsTtl,
+			},
+			Ns: ns,
+		})
+	}
+	return
+}
+
+// sets the configured ttls of generated records
+func (t *ZoneTimers) ApplyTtls(rrs []dns.RR) {
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		switch hdr.Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+			if t.AddressTtl > 0 {
+				hdr.Ttl = t.AddressTtl
+			}
+		case dns.TypeTXT:
+			if t.TxtTtl > 0 {
+				hdr.Ttl = t.TxtTtl
+			}
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package dnsutil
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	TransferChunkSize       = 100 // records per message
+	TransferRefreshInterval = time.Minute
+)
+
+// optionally implemented by a RecordGenerator, along with TypeLister, to list the names with records,
+// allowing zone transfers
+type NameLister interface {
+	ListNames(ctx context.Context, zone string) (names []string, err error)
+}
+
+func (h *SimpleHandler) transferEnabled() bool {
+	return len(h.TransferACL) > 0 || len(h.TransferKeys) > 0
+}
+
+// parses the transfer ACL, starts periodically checking for zone changes if transfers are enabled,
+// such as expired records or changes by other instances.
+// transfers only contain unsigned records, so they are refused for signed zones
+func (h *SimpleHandler) initTransfer() error {
+	if h.transferEnabled() && h.DnssecProvider != nil {
+		return fmt.Errorf("zone transfers of signed zones are not supported")
+	}
+	nets, err := ParsePrefixes(h.TransferACL)
+	if err != nil {
+		return fmt.Errorf("invalid transfer ACL: %w", err)
+	}
+	h.transferNets = nets
+	if !h.transferEnabled() {
+		return nil
+	}
+	go func() {
+		for {
+			time.Sleep(TransferRefreshInterval)
+			if _, _, err := h.refreshSerial(context.Background()); err != nil {
+				log.Printf("[error] SimpleHandler.refreshSerial (%v): %v", h.Zone, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// sets the initial SOA serial. without transfers, changes aren't tracked and the serial is always 1.
+func (h *SimpleHandler) initSerial() error {
+	if !h.transferEnabled() {
+		return h.setSerial(1)
+	}
+	_, _, err := h.refreshSerial(context.Background())
+	if err != nil {
+		// retried by the refresh loop
+		log.Printf("[error] SimpleHandler.refreshSerial (%v): %v", h.Zone, err)
+		return h.setSerial(uint32(time.Now().Unix()))
+	}
+	return nil
+}
+
+// gets all records of the zone except the SOA. names with no stored data are not included.
+func (h *SimpleHandler) zoneRecords(ctx context.Context) (rrs []dns.RR, err error) {
+	rrs = h.Timers.NS(h.Zone, h.Ns)
+	for _, rr := range h.StaticRecords {
+		if rr.Header().Class == dns.ClassINET {
+			rrs = append(rrs, dns.Copy(rr))
+		}
+	}
+	nameLister, ok := h.RecordGenerator.(NameLister)
+	if !ok {
+		return
+	}
+	typeLister, ok := h.RecordGenerator.(TypeLister)
+	if !ok {
+		return
+	}
+	names, err := nameLister.ListNames(ctx, h.Zone)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		types, err := typeLister.ListTypes(ctx, name, h.Zone)
+		if err != nil {
+			return nil, err
+		}
+		for _, rrtype := range types {
+			generated, _, err := h.generateRecords(ctx, &dns.Question{Name: name, Qtype: rrtype, Qclass: dns.ClassINET})
+			if err != nil {
+				return nil, err
+			}
+			for _, rr := range generated {
+				if rr.Header().Rrtype == rrtype {
+					rrs = append(rrs, rr)
+				}
+			}
+		}
+	}
+	return
+}
+
+// gets the zone's records, increasing the SOA serial and notifying secondaries if they've changed,
+// returns the current serial. serials are time based and tracked per instance, so secondaries should
+// transfer from, and be notified by, a single instance rather than an anycast address.
+func (h *SimpleHandler) refreshSerial(ctx context.Context) (rrs []dns.RR, serial uint32, err error) {
+	rrs, err = h.zoneRecords(ctx)
+	if err != nil {
+		return
+	}
+	strs := make([]string, len(rrs))
+	for i, rr := range rrs {
+		strs[i] = rr.String()
+	}
+	slices.Sort(strs)
+	f := fnv.New64a()
+	for _, str := range strs {
+		f.Write([]byte(str))
+		f.Write([]byte{'\n'})
+	}
+	sum := f.Sum64()
+	h.soaMu.Lock()
+	defer h.soaMu.Unlock()
+	st := h.soa.Load()
+	if st != nil && sum == h.zoneHash {
+		return rrs, st.serial, nil
+	}
+	// time based, always increasing
+	serial = uint32(time.Now().Unix())
+	if st != nil && int32(serial-st.serial) <= 0 {
+		serial = st.serial + 1
+	}
+	err = h.setSerial(serial)
+	if err != nil {
+		return
+	}
+	h.zoneHash = sum
+	if st != nil {
+		h.notify(serial)
+	}
+	return
+}
+
+// checks if keyName is one of the zone's transfer keys
+func (h *SimpleHandler) isTransferKey(keyName string) bool {
+	for name := range h.TransferKeys {
+		if EqualsAsciiIgnoreCase(dns.CanonicalName(name), keyName) {
+			return true
+		}
+	}
+	return false
+}
+
+// checks if the sender of req may transfer the zone
+func (h *SimpleHandler) transferAllowed(w dns.ResponseWriter, req *dns.Msg) bool {
+	if t := req.IsTsig(); t != nil && h.isTransferKey(t.Hdr.Name) {
+		return w.TsigStatus() == nil
+	}
+	addr, ok := RemoteAddr(w)
+	if !ok {
+		return false
+	}
+	for _, prefix := range h.transferNets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// serves AXFR (rfc5936) and IXFR (rfc1995) queries, IXFR always falls back to a full transfer
+func (h *SimpleHandler) serveTransfer(w dns.ResponseWriter, req *dns.Msg) {
+	q := &req.Question[0]
+	t := req.IsTsig()
+	send := func(resp *dns.Msg) error {
+		if t != nil && w.TsigStatus() == nil {
+			resp.SetTsig(t.Hdr.Name, t.Algorithm, TsigFudge, time.Now().Unix())
+		}
+		return w.WriteMsg(resp)
+	}
+	if q.Qclass != dns.ClassINET {
+		send(new(dns.Msg).SetRcode(req, dns.RcodeNotImplemented))
+		return
+	}
+	if len(q.Name) != len(h.Zone) {
+		send(new(dns.Msg).SetRcode(req, dns.RcodeNotAuth))
+		return
+	}
+	if !h.transferEnabled() || !h.transferAllowed(w, req) {
+		if t != nil && w.TsigStatus() != nil {
+			log.Printf("[warn] SimpleHandler.serveTransfer (%v): TSIG %v from %s: %v", h.Zone, t.Hdr.Name, w.RemoteAddr(), w.TsigStatus())
+			send(new(dns.Msg).SetRcode(req, dns.RcodeNotAuth))
+			return
+		}
+		send(new(dns.Msg).SetRcode(req, dns.RcodeRefused))
+		return
+	}
+	rrs, serial, err := h.refreshSerial(RequestContext(w))
+	if err != nil {
+		log.Printf("[error] SimpleHandler.serveTransfer (%v): %v", h.Zone, err)
+		send(new(dns.Msg).SetRcode(req, dns.RcodeServerFailure))
+		return
+	}
+	soa := h.soaRecord(q.Name, serial)
+	// ixfr, up to date or not over a stream
+	proto := GetProtocol(w)
+	stream := proto == ProtoTCP || proto == ProtoTLS
+	if q.Qtype == dns.TypeIXFR {
+		var clientSerial uint32
+		var hasSerial bool
+		for _, rr := range req.Ns {
+			if s, ok := rr.(*dns.SOA); ok {
+				clientSerial, hasSerial = s.Serial, true
+				break
+			}
+		}
+		if !hasSerial {
+			send(new(dns.Msg).SetRcodeFormatError(req))
+			return
+		}
+		if int32(serial-clientSerial) <= 0 || !stream {
+			resp := new(dns.Msg).SetReply(req)
+			resp.Authoritative = true
+			resp.Answer = []dns.RR{soa}
+			send(resp)
+			return
+		}
+	} else if !stream {
+		send(new(dns.Msg).SetRcode(req, dns.RcodeRefused))
+		return
+	}
+	// full transfer
+	rrs = append([]dns.RR{soa}, rrs...)
+	rrs = append(rrs, soa)
+	for i := 0; i < len(rrs); i += TransferChunkSize {
+		resp := new(dns.Msg).SetReply(req)
+		resp.Authoritative = true
+		resp.Compress = true
+		resp.Answer = rrs[i:min(i+TransferChunkSize, len(rrs))]
+		if err := send(resp); err != nil {
+			log.Printf("[error] SimpleHandler.serveTransfer (%v): %v", h.Zone, err)
+			return
+		}
+		w.TsigTimersOnly(true)
+	}
+	log.Printf("[info] SimpleHandler.serveTransfer (%v): serial %v, %v records to %s", h.Zone, serial, len(rrs)-1, w.RemoteAddr())
+}
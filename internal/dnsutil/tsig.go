@@ -0,0 +1,135 @@
+package dnsutil
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const TsigFudge = 300
+
+type TsigSecretGetter interface {
+	// gets the raw secret for the TSIG key keyName in zone, or nil if no such key exists
+	TsigSecret(ctx context.Context, keyName, zone string) (secret []byte, err error)
+}
+
+// derives a TSIG secret from a server-side key and parts, so that stored data alone is not a credential
+func DeriveTsigSecret(key []byte, parts ...string) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, part := range parts {
+		mac.Write(binary.AppendUvarint(nil, uint64(len(part))))
+		mac.Write([]byte(part))
+	}
+	return mac.Sum(nil)
+}
+
+// a dns.TsigProvider which looks up secrets by name, then by zone
+type TsigMux struct {
+	mu   sync.RWMutex
+	m    map[string]TsigSecretGetter
+	keys map[string][]byte
+}
+
+func (mux *TsigMux) AddKey(keyName string, secret []byte) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	if mux.keys == nil {
+		mux.keys = make(map[string][]byte)
+	}
+	mux.keys[ToLowerAscii(dns.CanonicalName(keyName))] = secret
+}
+
+// checks if keyName was added with AddKey
+func (mux *TsigMux) HasKey(keyName string) bool {
+	if mux == nil {
+		return false
+	}
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	_, ok := mux.keys[ToLowerAscii(dns.CanonicalName(keyName))]
+	return ok
+}
+
+func (mux *TsigMux) Handle(zone string, g TsigSecretGetter) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	if mux.m == nil {
+		mux.m = make(map[string]TsigSecretGetter)
+	}
+	mux.m[ToLowerAscii(dns.CanonicalName(zone))] = g
+}
+
+func (mux *TsigMux) secret(keyName string) ([]byte, error) {
+	keyName = ToLowerAscii(keyName)
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	if secret, ok := mux.keys[keyName]; ok {
+		if len(secret) == 0 {
+			return nil, dns.ErrSecret
+		}
+		return secret, nil
+	}
+	for off, end := 0, false; !end; off, end = dns.NextLabel(keyName, off) {
+		if g, ok := mux.m[keyName[off:]]; ok {
+			// dns.TsigProvider has no context, limited like a lookup
+			ctx, cancel := context.WithTimeout(context.Background(), DefaultLookupTimeout)
+			secret, err := g.TsigSecret(ctx, keyName, keyName[off:])
+			cancel()
+			if err != nil {
+				return nil, err
+			}
+			if len(secret) == 0 {
+				return nil, dns.ErrSecret
+			}
+			return secret, nil
+		}
+	}
+	return nil, dns.ErrSecret
+}
+
+func (mux *TsigMux) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	secret, err := mux.secret(t.Hdr.Name)
+	if err != nil {
+		return nil, err
+	}
+	var h hash.Hash
+	switch ToLowerAscii(dns.CanonicalName(t.Algorithm)) {
+	case dns.HmacSHA1:
+		h = hmac.New(sha1.New, secret)
+	case dns.HmacSHA224:
+		h = hmac.New(sha256.New224, secret)
+	case dns.HmacSHA256:
+		h = hmac.New(sha256.New, secret)
+	case dns.HmacSHA384:
+		h = hmac.New(sha512.New384, secret)
+	case dns.HmacSHA512:
+		h = hmac.New(sha512.New, secret)
+	default:
+		return nil, dns.ErrKeyAlg
+	}
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+func (mux *TsigMux) Verify(msg []byte, t *dns.TSIG) error {
+	b, err := mux.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(b, mac) {
+		return dns.ErrSig
+	}
+	return nil
+}
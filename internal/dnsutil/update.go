@@ -0,0 +1,244 @@
+package dnsutil
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type RecordUpdater interface {
+	// applies the update section of an rfc2136 update message authorized by the TSIG key keyName,
+	// returns the response rcode
+	UpdateRecords(ctx context.Context, update []dns.RR, zone, keyName string) (rcode int, err error)
+}
+
+// gets the rrset of type rrtype at name, including apex and static records
+func (h *SimpleHandler) rrset(ctx context.Context, name string, rrtype uint16) (rrs []dns.RR, nameExists bool, err error) {
+	q := &dns.Question{Name: name, Qtype: rrtype, Qclass: dns.ClassINET}
+	if len(name) == len(h.Zone) {
+		nameExists = true
+		switch rrtype {
+		case dns.TypeSOA:
+			rrs = append(rrs, h.SOA(q, false)...)
+		case dns.TypeNS:
+			rrs = append(rrs, h.Timers.NS(name, h.Ns)...)
+		case dns.TypeCDS, dns.TypeCDNSKEY:
+			cds, err := h.DnssecProvider.Cds(name, rrtype)
+			if err != nil {
+				return nil, false, err
+			}
+			rrs = append(rrs, cds...)
+		case dns.TypeNSEC3PARAM:
+			rrs = append(rrs, h.DnssecProvider.Nsec3Param(name)...)
+		}
+	}
+	if h.StaticRecords != nil {
+		static, validName := h.StaticRecords.Get(q)
+		for _, rr := range static {
+			if rr.Header().Rrtype == rrtype {
+				rrs = append(rrs, rr)
+			}
+		}
+		nameExists = nameExists || validName
+	}
+	if h.RecordGenerator != nil {
+		generated, validName, err := h.generateRecords(ctx, q)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, rr := range generated {
+			if rr.Header().Rrtype == rrtype {
+				rrs = append(rrs, rr)
+			}
+		}
+		nameExists = nameExists || validName
+	}
+	return
+}
+
+// checks the prerequisite section of an rfc2136 update message, returns the response rcode
+func (h *SimpleHandler) checkPrerequisites(ctx context.Context, prereqs []dns.RR) (int, error) {
+	// value-dependent prerequisites are compared as whole rrsets
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
+	}
+	var rrsets map[rrsetKey][]dns.RR
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError, nil
+		}
+		if !dns.IsSubDomain(h.Zone, hdr.Name) {
+			return dns.RcodeNotZone, nil
+		}
+		empty := hdr.Rdlength == 0
+		switch hdr.Class {
+		case dns.ClassANY:
+			if !empty {
+				return dns.RcodeFormatError, nil
+			}
+			rrs, nameExists, err := h.rrset(ctx, hdr.Name, hdr.Rrtype)
+			if err != nil {
+				return dns.RcodeServerFailure, err
+			}
+			if hdr.Rrtype == dns.TypeANY {
+				// name is in use
+				if !nameExists {
+					return dns.RcodeNameError, nil
+				}
+			} else if len(rrs) == 0 {
+				// rrset exists (value independent)
+				return dns.RcodeNXRrset, nil
+			}
+		case dns.ClassNONE:
+			if !empty {
+				return dns.RcodeFormatError, nil
+			}
+			rrs, nameExists, err := h.rrset(ctx, hdr.Name, hdr.Rrtype)
+			if err != nil {
+				return dns.RcodeServerFailure, err
+			}
+			if hdr.Rrtype == dns.TypeANY {
+				// name is not in use
+				if nameExists {
+					return dns.RcodeYXDomain, nil
+				}
+			} else if len(rrs) > 0 {
+				// rrset does not exist
+				return dns.RcodeYXRrset, nil
+			}
+		case dns.ClassINET:
+			if empty || hdr.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError, nil
+			}
+			if rrsets == nil {
+				rrsets = make(map[rrsetKey][]dns.RR)
+			}
+			key := rrsetKey{ToLowerAscii(hdr.Name), hdr.Rrtype}
+			rrsets[key] = append(rrsets[key], rr)
+		default:
+			return dns.RcodeFormatError, nil
+		}
+	}
+	for key, expected := range rrsets {
+		// rrset exists (value dependent)
+		rrs, _, err := h.rrset(ctx, key.name, key.rrtype)
+		if err != nil {
+			return dns.RcodeServerFailure, err
+		}
+		if !equalRRsets(rrs, expected) {
+			return dns.RcodeNXRrset, nil
+		}
+	}
+	return dns.RcodeSuccess, nil
+}
+
+// compares rrsets ignoring ttls, order, and name case
+func equalRRsets(a, b []dns.RR) bool {
+	contains := func(rrs []dns.RR, rr dns.RR) bool {
+		for _, x := range rrs {
+			if dns.IsDuplicate(x, rr) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rr := range a {
+		if !contains(b, rr) {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if !contains(a, rr) {
+			return false
+		}
+	}
+	return true
+}
+
+// checks the update section of an rfc2136 update message, returns the response rcode
+func (h *SimpleHandler) prescanUpdate(update []dns.RR) int {
+	for _, rr := range update {
+		hdr := rr.Header()
+		if !dns.IsSubDomain(h.Zone, hdr.Name) {
+			return dns.RcodeNotZone
+		}
+		empty := hdr.Rdlength == 0
+		switch hdr.Class {
+		case dns.ClassINET:
+			if empty || hdr.Rrtype == dns.TypeANY || hdr.Rrtype&128 != 0 || hdr.Rrtype == dns.TypeOPT {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if !empty || hdr.Ttl != 0 || (hdr.Rrtype != dns.TypeANY && hdr.Rrtype&128 != 0) {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if empty || hdr.Ttl != 0 || hdr.Rrtype == dns.TypeANY || hdr.Rrtype&128 != 0 {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+func (h *SimpleHandler) serveUpdate(w dns.ResponseWriter, req *dns.Msg) {
+	z := &req.Question[0]
+	resp := new(dns.Msg).SetReply(req)
+	defer func() {
+		w.WriteMsg(resp)
+	}()
+	// zone section must be the apex SOA
+	if z.Qclass != dns.ClassINET || z.Qtype != dns.TypeSOA {
+		resp.Rcode = dns.RcodeFormatError
+		return
+	}
+	if len(z.Name) != len(h.Zone) {
+		resp.Rcode = dns.RcodeNotAuth
+		return
+	}
+	// updates must be signed by a valid key
+	t := req.IsTsig()
+	if t == nil {
+		resp.Rcode = dns.RcodeRefused
+		return
+	}
+	if err := w.TsigStatus(); err != nil {
+		log.Printf("[warn] SimpleHandler.serveUpdate (%v): TSIG %v from %s: %v", h.Zone, t.Hdr.Name, w.RemoteAddr(), err)
+		resp.Rcode = dns.RcodeNotAuth
+		return
+	}
+	// sign the response with the same key
+	defer func() {
+		resp.SetTsig(t.Hdr.Name, t.Algorithm, TsigFudge, time.Now().Unix())
+	}()
+	// transfer keys only authorize transfers
+	if h.isTransferKey(t.Hdr.Name) || h.TsigKeys.HasKey(t.Hdr.Name) {
+		resp.Rcode = dns.RcodeRefused
+		return
+	}
+	updater, ok := h.RecordGenerator.(RecordUpdater)
+	if !ok {
+		resp.Rcode = dns.RcodeRefused
+		return
+	}
+	// not limited like lookups, so a slow store doesn't leave a change half made
+	ctx := RequestContext(w)
+	rcode, err := h.checkPrerequisites(ctx, req.Answer)
+	if err == nil && rcode == dns.RcodeSuccess {
+		rcode = h.prescanUpdate(req.Ns)
+		if rcode == dns.RcodeSuccess {
+			rcode, err = updater.UpdateRecords(ctx, req.Ns, h.Zone, ToLowerAscii(t.Hdr.Name))
+		}
+	}
+	if err != nil {
+		log.Printf("[error] SimpleHandler.serveUpdate (%v): %v", h.Zone, err)
+		rcode = dns.RcodeServerFailure
+	}
+	resp.Rcode = rcode
+}
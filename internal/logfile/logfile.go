@@ -0,0 +1,96 @@
+package logfile
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+)
+
+// an appending log file which can be reopened after rotation
+type File struct {
+	Path string
+	mu   sync.Mutex
+	f    *os.File
+	buf  *bufio.Writer
+	w    io.Writer
+}
+
+// opens path for appending, buffering writes if buffered
+func Open(path string, buffered bool) (*File, error) {
+	f := &File{Path: path}
+	if buffered {
+		f.buf = bufio.NewWriter(nil)
+	}
+	return f, f.open()
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.Path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	f.f = file
+	if f.buf != nil {
+		f.buf.Reset(file)
+		f.w = f.buf
+	} else {
+		f.w = file
+	}
+	return nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.w.Write(p)
+}
+
+func (f *File) flush() error {
+	if f.buf == nil {
+		return nil
+	}
+	return f.buf.Flush()
+}
+
+func (f *File) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.flush()
+}
+
+// closes the file if open
+func (f *File) close() error {
+	if f.f == nil {
+		return nil
+	}
+	err := f.f.Close()
+	f.f = nil
+	return err
+}
+
+// flushes and closes the file, then opens the path again, e.g. after the file was moved by logrotate
+func (f *File) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.flush()
+	if err1 := f.close(); err1 != nil && err == nil {
+		err = err1
+	}
+	if err1 := f.open(); err1 != nil {
+		// keep writes from failing until the next reopen
+		f.w = io.Discard
+		return err1
+	}
+	return err
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.flush()
+	if err1 := f.close(); err1 != nil && err == nil {
+		err = err1
+	}
+	return err
+}
@@ -0,0 +1,276 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// latency buckets in seconds
+var DefBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// the registry of metrics created by this package
+var DefaultRegistry = new(Registry)
+
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+// exports metrics in the Prometheus text format
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, other := range r.collectors {
+		if other.name() == c.name() {
+			panic("duplicate metric: " + c.name())
+		}
+	}
+	r.collectors = append(r.collectors, c)
+}
+
+func (r *Registry) Export(w io.Writer) {
+	r.mu.Lock()
+	collectors := slices.Clone(r.collectors)
+	r.mu.Unlock()
+	slices.SortFunc(collectors, func(a, b collector) int { return strings.Compare(a.name(), b.name()) })
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Export(w)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formats label names and values, with an optional extra label
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && len(extraName) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, labelValueEscaper.Replace(values[i]))
+	}
+	if len(extraName) > 0 {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, extraName, extraValue)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// a set of series keyed by label values
+type series[T any] struct {
+	mu     sync.RWMutex
+	labels []string
+	m      map[string]*T
+	values map[string][]string
+	create func() *T
+}
+
+func (s *series[T]) with(values []string) *T {
+	if len(values) != len(s.labels) {
+		panic("wrong number of label values")
+	}
+	key := strings.Join(values, "\xff")
+	s.mu.RLock()
+	v := s.m[key]
+	s.mu.RUnlock()
+	if v != nil {
+		return v
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v = s.m[key]; v == nil {
+		v = s.create()
+		s.m[key] = v
+		s.values[key] = slices.Clone(values)
+	}
+	return v
+}
+
+// calls f for each series in label order
+func (s *series[T]) each(f func(values []string, v *T)) {
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.m))
+	for key := range s.m {
+		keys = append(keys, key)
+	}
+	s.mu.RUnlock()
+	slices.Sort(keys)
+	for _, key := range keys {
+		s.mu.RLock()
+		v, values := s.m[key], s.values[key]
+		s.mu.RUnlock()
+		f(values, v)
+	}
+}
+
+func newSeries[T any](labels []string, create func() *T) series[T] {
+	return series[T]{labels: labels, m: make(map[string]*T), values: make(map[string][]string), create: create}
+}
+
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+type CounterVec struct {
+	Name string
+	Help string
+	series[Counter]
+}
+
+// creates and registers a counter with labels
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{Name: name, Help: help, series: newSeries(labels, func() *Counter { return new(Counter) })}
+	DefaultRegistry.register(c)
+	return c
+}
+
+// creates and registers a counter without labels
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help).With()
+}
+
+// gets the counter with label values
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.with(values)
+}
+
+func (c *CounterVec) name() string { return c.Name }
+
+func (c *CounterVec) write(w io.Writer) {
+	writeHeader(w, c.Name, c.Help, "counter")
+	c.each(func(values []string, v *Counter) {
+		fmt.Fprintf(w, "%s%s %d\n", c.Name, formatLabels(c.labels, values, "", ""), v.Value())
+	})
+}
+
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	i, _ := slices.BinarySearch(h.buckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+type HistogramVec struct {
+	Name    string
+	Help    string
+	Buckets []float64
+	series[Histogram]
+}
+
+// creates and registers a histogram with sorted buckets and labels
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{Name: name, Help: help, Buckets: buckets}
+	h.series = newSeries(labels, func() *Histogram {
+		return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	})
+	DefaultRegistry.register(h)
+	return h
+}
+
+// gets the histogram with label values
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.with(values)
+}
+
+func (h *HistogramVec) name() string { return h.Name }
+
+func (h *HistogramVec) write(w io.Writer) {
+	writeHeader(w, h.Name, h.Help, "histogram")
+	h.each(func(values []string, v *Histogram) {
+		v.mu.Lock()
+		counts, sum, count := slices.Clone(v.counts), v.sum, v.count
+		v.mu.Unlock()
+		var cumulative uint64
+		for i, le := range h.Buckets {
+			cumulative += counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, formatLabels(h.labels, values, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, formatLabels(h.labels, values, "le", "+Inf"), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.Name, formatLabels(h.labels, values, "", ""), formatFloat(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.Name, formatLabels(h.labels, values, "", ""), count)
+	})
+}
+
+// a gauge or counter read from a function when exported
+type funcMetric struct {
+	Name string
+	Help string
+	Type string
+	f    func() float64
+}
+
+func (m *funcMetric) name() string { return m.Name }
+
+func (m *funcMetric) write(w io.Writer) {
+	writeHeader(w, m.Name, m.Help, m.Type)
+	fmt.Fprintf(w, "%s %s\n", m.Name, formatFloat(m.f()))
+}
+
+// creates and registers a gauge read from f
+func NewGaugeFunc(name, help string, f func() float64) {
+	DefaultRegistry.register(&funcMetric{name, help, "gauge", f})
+}
+
+// creates and registers a counter read from f
+func NewCounterFunc(name, help string, f func() float64) {
+	DefaultRegistry.register(&funcMetric{name, help, "counter", f})
+}
@@ -0,0 +1,179 @@
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultHealthCheckTimeout = 2 * time.Second
+	HealthCheckInterval       = 10 * time.Second // of background checks, see Start
+)
+
+var errNotChecked = errors.New("not checked yet")
+
+type healthCheck struct {
+	name      string
+	readiness bool
+	check     func(ctx context.Context) error
+}
+
+type HealthResult struct {
+	Name string
+	Err  error
+}
+
+// runs health checks concurrently within a deadline. liveness checks should only fail when a restart may
+// help, readiness checks include everything needed to serve correctly.
+type HealthChecker struct {
+	Timeout   time.Duration
+	mu        sync.RWMutex
+	checks    []healthCheck
+	liveness  atomic.Pointer[healthState]
+	readiness atomic.Pointer[healthState]
+}
+
+// the results of the last background checks
+type healthState struct {
+	results []HealthResult
+	healthy bool
+}
+
+// adds a liveness check, also checked for readiness
+func (c *HealthChecker) AddLiveness(name string, check func(ctx context.Context) error) {
+	c.add(healthCheck{name, false, check})
+}
+
+// adds a readiness-only check
+func (c *HealthChecker) AddReadiness(name string, check func(ctx context.Context) error) {
+	c.add(healthCheck{name, true, check})
+}
+
+func (c *HealthChecker) add(hc healthCheck) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, hc)
+}
+
+// gets the checks to run, the liveness checks or all checks if readiness
+func (c *HealthChecker) list(readiness bool) (checks []healthCheck) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, hc := range c.checks {
+		if readiness || !hc.readiness {
+			checks = append(checks, hc)
+		}
+	}
+	return
+}
+
+// runs the liveness checks, or all checks if readiness, returns results in the order added.
+// checks not finished by the deadline, or before ctx is done, fail.
+func (c *HealthChecker) Run(ctx context.Context, readiness bool) (results []HealthResult, healthy bool) {
+	results = c.run(ctx, c.list(readiness))
+	return results, isHealthy(results)
+}
+
+// starts running all checks every HealthCheckInterval in the background, for Cached
+func (c *HealthChecker) Start() {
+	go func() {
+		for {
+			checks := c.list(true)
+			results := c.run(context.Background(), checks)
+			var liveness []HealthResult
+			for i, hc := range checks {
+				if !hc.readiness {
+					liveness = append(liveness, results[i])
+				}
+			}
+			c.liveness.Store(&healthState{liveness, isHealthy(liveness)})
+			c.readiness.Store(&healthState{results, isHealthy(results)})
+			time.Sleep(HealthCheckInterval)
+		}
+	}()
+}
+
+// gets the results of the last background run of the liveness checks, or all checks if readiness,
+// without running any. fails until the first run finishes, see Start.
+func (c *HealthChecker) Cached(readiness bool) (results []HealthResult, healthy bool) {
+	st := c.liveness.Load()
+	if readiness {
+		st = c.readiness.Load()
+	}
+	if st == nil {
+		return []HealthResult{{Name: "health", Err: errNotChecked}}, false
+	}
+	return st.results, st.healthy
+}
+
+// runs checks concurrently within the deadline
+func (c *HealthChecker) run(ctx context.Context, checks []healthCheck) []HealthResult {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	results := make([]HealthResult, len(checks))
+	var wg sync.WaitGroup
+	for i, hc := range checks {
+		results[i].Name = hc.name
+		done := make(chan error, 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			go func() {
+				done <- hc.check(ctx)
+			}()
+			select {
+			case err := <-done:
+				results[i].Err = err
+			case <-ctx.Done():
+				results[i].Err = ctx.Err()
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func isHealthy(results []HealthResult) bool {
+	for _, r := range results {
+		if r.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// gets an http handler responding 200 if healthy, otherwise 503, with the result of each check
+func (c *HealthChecker) Handler(readiness bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		results, healthy := c.Run(req.Context(), readiness)
+		w.Header().Add("Content-Type", "text/plain")
+		w.Header().Add("Cache-Control", "no-store")
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\n", r)
+		}
+		if healthy {
+			fmt.Fprint(w, "ok\n")
+		} else {
+			fmt.Fprint(w, "failed\n")
+		}
+	})
+}
+
+func (r HealthResult) String() string {
+	if r.Err != nil {
+		return r.Name + ": " + r.Err.Error()
+	}
+	return r.Name + ": ok"
+}
@@ -1,8 +1,13 @@
 package status
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/brianshea2/addr.tools/internal/dnsutil"
@@ -11,11 +16,61 @@ import (
 
 type Status struct {
 	Title string
-	Value string
+	Value any // a string, number, time.Duration, or time.Time
 }
 
-func (s *Status) String() string {
-	return s.Title + ": " + s.Value
+// formats the value for text output
+func (s Status) FormatValue() string {
+	switch v := s.Value.(type) {
+	case string:
+		return v
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// gets the value for JSON output, durations are in seconds
+func (s Status) jsonValue() any {
+	switch v := s.Value.(type) {
+	case time.Duration:
+		return v.Seconds()
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	default:
+		return v
+	}
+}
+
+func (s Status) String() string {
+	return s.Title + ": " + s.FormatValue()
+}
+
+// encodes statuses as a JSON object, keeping their order
+func MarshalJSON(ss []Status) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i := range ss {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		title, err := json.Marshal(ss[i].Title)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(ss[i].jsonValue())
+		if err != nil {
+			return nil, err
+		}
+		b.Write(title)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
 }
 
 type StatusProvider interface {
@@ -28,6 +83,7 @@ func (f StatusProviderFunc) GetStatus() []Status { return f() }
 
 type StatusHandler struct {
 	Providers []StatusProvider
+	Health    *HealthChecker // answers TXT queries for the healthz and readyz subdomains if set and started
 }
 
 func (h *StatusHandler) Add(p StatusProvider) {
@@ -41,31 +97,109 @@ func (h *StatusHandler) GetStatus() (ss []Status) {
 	return
 }
 
-func (h *StatusHandler) GenerateRecords(q *dns.Question, zone string) (rrs []dns.RR, validName bool, err error) {
+func txtRecords(name string, strs []string) []dns.RR {
+	rrs := make([]dns.RR, len(strs))
+	for i, str := range strs {
+		rrs[i] = &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassINET,
+				Ttl:    1,
+			},
+			Txt: dnsutil.SplitForTxt(str),
+		}
+	}
+	return rrs
+}
+
+func (h *StatusHandler) GenerateRecords(ctx context.Context, q *dns.Question, zone string) (rrs []dns.RR, validName bool, err error) {
 	if len(q.Name) == len(zone) {
 		validName = true
 		if q.Qtype == dns.TypeTXT {
 			ss := h.GetStatus()
-			rrs = make([]dns.RR, len(ss))
+			strs := make([]string, len(ss))
 			for i, s := range ss {
-				rrs[i] = &dns.TXT{
-					Hdr: dns.RR_Header{
-						Name:   q.Name,
-						Rrtype: dns.TypeTXT,
-						Class:  dns.ClassINET,
-						Ttl:    1,
-					},
-					Txt: dnsutil.SplitForTxt(s.String()),
-				}
+				strs[i] = s.String()
 			}
+			rrs = txtRecords(q.Name, strs)
 		}
+		return
+	}
+	if h.Health == nil {
+		return
+	}
+	// health probes, a TXT record for each check plus one of "ok" or "failed"
+	var readiness bool
+	switch sub := q.Name[:len(q.Name)-len(zone)]; {
+	case dnsutil.EqualsAsciiIgnoreCase(sub, "healthz."):
+	case dnsutil.EqualsAsciiIgnoreCase(sub, "readyz."):
+		readiness = true
+	default:
+		return
+	}
+	validName = true
+	if q.Qtype == dns.TypeTXT {
+		// cached, so queries can't be used to run checks
+		results, healthy := h.Health.Cached(readiness)
+		strs := make([]string, len(results), len(results)+1)
+		for i, r := range results {
+			strs[i] = r.String()
+		}
+		if healthy {
+			strs = append(strs, "ok")
+		} else {
+			strs = append(strs, "failed")
+		}
+		rrs = txtRecords(q.Name, strs)
 	}
 	return
 }
 
+// checks if the client prefers JSON, via the format query parameter or the Accept header
+func wantsJSON(req *http.Request) bool {
+	switch req.URL.Query().Get("format") {
+	case "json":
+		return true
+	case "text":
+		return false
+	}
+	var jsonQ, textQ float64
+	for _, mediaRange := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(mediaRange, ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/json":
+			jsonQ = max(jsonQ, q)
+		case "text/plain", "text/*", "*/*":
+			textQ = max(textQ, q)
+		}
+	}
+	return jsonQ > textQ
+}
+
 func (h *StatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Add("Vary", "Accept")
+	ss := h.GetStatus()
+	if wantsJSON(req) {
+		b, err := MarshalJSON(ss)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(b)
+		return
+	}
 	w.Header().Add("Content-Type", "text/plain")
-	for _, s := range h.GetStatus() {
+	for _, s := range ss {
 		fmt.Fprintf(w, "%s\n", s)
 	}
 }
@@ -79,5 +213,8 @@ func NewUptimeProvider() *UptimeProvider {
 }
 
 func (p *UptimeProvider) GetStatus() []Status {
-	return []Status{{"uptime", time.Since(p.boot).Truncate(time.Second).String()}}
+	return []Status{
+		{"started", p.boot},
+		{"uptime", time.Since(p.boot).Truncate(time.Second)},
+	}
 }
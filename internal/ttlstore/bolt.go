@@ -0,0 +1,267 @@
+package ttlstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltValuesBucket = []byte("values") // key to encoded values
+	boltExpiryBucket = []byte("expiry") // expiration and key, for pruning
+)
+
+// a TtlStore in an embedded transactional database. keys are ordered, so List is a range scan.
+type BoltTtlStore struct {
+	db *bolt.DB
+}
+
+// opens or creates the database at path
+func OpenBoltTtlStore(path string) (*BoltTtlStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltValuesBucket, boltExpiryBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltTtlStore{db}, nil
+}
+
+func (s *BoltTtlStore) Close() error {
+	return s.db.Close()
+}
+
+// gets the number of keys, including any with only expired values
+func (s *BoltTtlStore) Size() (n int) {
+	s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(boltValuesBucket).Stats().KeyN
+		return nil
+	})
+	return
+}
+
+func encodeValues(rs []ValueWithExpiration) []byte {
+	var b []byte
+	for _, r := range rs {
+		b = binary.BigEndian.AppendUint32(b, r.Expires)
+		b = binary.AppendUvarint(b, uint64(len(r.Value)))
+		b = append(b, r.Value...)
+	}
+	return b
+}
+
+// decodes values, copying them out of the transaction's memory
+func decodeValues(b []byte) (rs []ValueWithExpiration, err error) {
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errors.New("invalid encoded values")
+		}
+		expires := binary.BigEndian.Uint32(b)
+		n, size := binary.Uvarint(b[4:])
+		if size <= 0 || uint64(len(b)-4-size) < n {
+			return nil, errors.New("invalid encoded values")
+		}
+		b = b[4+size:]
+		rs = append(rs, ValueWithExpiration{expires, bytes.Clone(b[:n])})
+		b = b[n:]
+	}
+	return
+}
+
+func expiryKey(expires uint32, key string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, expires), key...)
+}
+
+// gets the non-expired values in rs
+func live(rs []ValueWithExpiration, now uint32) (l []ValueWithExpiration) {
+	for _, r := range rs {
+		if r.Expires > now {
+			l = append(l, r)
+		}
+	}
+	return
+}
+
+func getValues(tx *bolt.Tx, key string) ([]ValueWithExpiration, error) {
+	return decodeValues(tx.Bucket(boltValuesBucket).Get([]byte(key)))
+}
+
+// replaces the values of key, old, with rs, updating the expiry index
+func putValues(tx *bolt.Tx, key string, old, rs []ValueWithExpiration) error {
+	expiry := tx.Bucket(boltExpiryBucket)
+	for _, r := range old {
+		if err := expiry.Delete(expiryKey(r.Expires, key)); err != nil {
+			return err
+		}
+	}
+	if len(rs) == 0 {
+		return tx.Bucket(boltValuesBucket).Delete([]byte(key))
+	}
+	for _, r := range rs {
+		if err := expiry.Put(expiryKey(r.Expires, key), []byte{}); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(boltValuesBucket).Put([]byte(key), encodeValues(rs))
+}
+
+// applies op to the values of key, given its non-expired values
+func applyOp(op Op, rs []ValueWithExpiration, now uint32) (kept []ValueWithExpiration, err error) {
+	switch op.Type {
+	case OpAdd:
+		kept = append(rs, ValueWithExpiration{now + op.Ttl, op.Value})
+	case OpSet:
+		kept = []ValueWithExpiration{{now + op.Ttl, op.Value}}
+	case OpRemove:
+		for _, r := range rs {
+			if !bytes.Equal(r.Value, op.Value) {
+				kept = append(kept, r)
+			}
+		}
+	case OpDelete:
+		// nothing kept
+	default:
+		err = fmt.Errorf("invalid op type: %v", op.Type)
+	}
+	return
+}
+
+// applies b in a single transaction
+func (s *BoltTtlStore) Apply(ctx context.Context, b Batch) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		now := uint32(time.Now().Unix())
+		for _, op := range b {
+			old, err := getValues(tx, op.Key)
+			if err != nil {
+				return err
+			}
+			rs, err := applyOp(op, live(old, now), now)
+			if err != nil {
+				return err
+			}
+			if err = putValues(tx, op.Key, old, rs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltTtlStore) Add(ctx context.Context, key string, val []byte, ttl uint32) error {
+	return s.Apply(ctx, Batch{{OpAdd, key, val, ttl}})
+}
+
+func (s *BoltTtlStore) Set(ctx context.Context, key string, val []byte, ttl uint32) error {
+	return s.Apply(ctx, Batch{{OpSet, key, val, ttl}})
+}
+
+func (s *BoltTtlStore) List(ctx context.Context, prefix string) (keys []string, err error) {
+	now := uint32(time.Now().Unix())
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltValuesBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			rs, err := decodeValues(v)
+			if err != nil {
+				return err
+			}
+			if len(live(rs, now)) > 0 {
+				keys = append(keys, string(k))
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// gets the non-expired values of key
+func (s *BoltTtlStore) values(ctx context.Context, key string) (rs []ValueWithExpiration, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		rs, err = getValues(tx, key)
+		return err
+	})
+	return live(rs, uint32(time.Now().Unix())), err
+}
+
+func (s *BoltTtlStore) Exists(ctx context.Context, key string) (exists bool, err error) {
+	rs, err := s.values(ctx, key)
+	return len(rs) > 0, err
+}
+
+func (s *BoltTtlStore) Values(ctx context.Context, key string) (vals [][]byte, err error) {
+	rs, err := s.values(ctx, key)
+	for _, r := range rs {
+		vals = append(vals, r.Value)
+	}
+	return
+}
+
+func (s *BoltTtlStore) Get(ctx context.Context, key string) (val []byte, err error) {
+	rs, err := s.values(ctx, key)
+	if len(rs) > 0 {
+		val = rs[0].Value
+	}
+	return
+}
+
+func (s *BoltTtlStore) Remove(ctx context.Context, key string, val []byte) error {
+	return s.Apply(ctx, Batch{{OpRemove, key, val, 0}})
+}
+
+func (s *BoltTtlStore) Delete(ctx context.Context, key string) error {
+	return s.Apply(ctx, Batch{{OpDelete, key, nil, 0}})
+}
+
+// removes expired values, scanning the expiry index
+func (s *BoltTtlStore) Prune() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		now := uint32(time.Now().Unix())
+		expiry := tx.Bucket(boltExpiryBucket)
+		var expired [][]byte
+		c := expiry.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint32(k) <= now; k, _ = c.Next() {
+			expired = append(expired, bytes.Clone(k))
+		}
+		for _, k := range expired {
+			if err := expiry.Delete(k); err != nil {
+				return err
+			}
+			key := string(k[4:])
+			old, err := getValues(tx, key)
+			if err != nil {
+				return err
+			}
+			if err = putValues(tx, key, old, live(old, now)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// removes expired values every interval, reporting errors to onError if not nil
+func (s *BoltTtlStore) PrunePeriodically(interval time.Duration, onError func(error)) {
+	for {
+		time.Sleep(interval)
+		if err := s.Prune(); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
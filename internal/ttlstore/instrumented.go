@@ -0,0 +1,86 @@
+package ttlstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/brianshea2/addr.tools/internal/metrics"
+)
+
+var (
+	storeOperationDuration = metrics.NewHistogramVec(
+		"addrd_store_operation_duration_seconds",
+		"TtlStore operation latency by store and operation.",
+		metrics.DefBuckets,
+		"store", "op",
+	)
+	storeErrors = metrics.NewCounterVec(
+		"addrd_store_errors_total",
+		"TtlStore operation errors by store and operation.",
+		"store", "op",
+	)
+)
+
+// a TtlStore which records the latency and errors of operations
+type Instrumented struct {
+	Store TtlStore
+	Name  string
+}
+
+// records an operation started at start, returning err
+func (s *Instrumented) observe(op string, start time.Time, err error) error {
+	storeOperationDuration.With(s.Name, op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		storeErrors.With(s.Name, op).Inc()
+	}
+	return err
+}
+
+func (s *Instrumented) Add(ctx context.Context, key string, val []byte, ttl uint32) error {
+	start := time.Now()
+	return s.observe("add", start, s.Store.Add(ctx, key, val, ttl))
+}
+
+func (s *Instrumented) Set(ctx context.Context, key string, val []byte, ttl uint32) error {
+	start := time.Now()
+	return s.observe("set", start, s.Store.Set(ctx, key, val, ttl))
+}
+
+func (s *Instrumented) List(ctx context.Context, prefix string) (keys []string, err error) {
+	start := time.Now()
+	keys, err = s.Store.List(ctx, prefix)
+	return keys, s.observe("list", start, err)
+}
+
+func (s *Instrumented) Exists(ctx context.Context, key string) (exists bool, err error) {
+	start := time.Now()
+	exists, err = s.Store.Exists(ctx, key)
+	return exists, s.observe("exists", start, err)
+}
+
+func (s *Instrumented) Values(ctx context.Context, key string) (vals [][]byte, err error) {
+	start := time.Now()
+	vals, err = s.Store.Values(ctx, key)
+	return vals, s.observe("values", start, err)
+}
+
+func (s *Instrumented) Get(ctx context.Context, key string) (val []byte, err error) {
+	start := time.Now()
+	val, err = s.Store.Get(ctx, key)
+	return val, s.observe("get", start, err)
+}
+
+func (s *Instrumented) Remove(ctx context.Context, key string, val []byte) error {
+	start := time.Now()
+	return s.observe("remove", start, s.Store.Remove(ctx, key, val))
+}
+
+func (s *Instrumented) Delete(ctx context.Context, key string) error {
+	start := time.Now()
+	return s.observe("delete", start, s.Store.Delete(ctx, key))
+}
+
+func (s *Instrumented) Apply(ctx context.Context, b Batch) error {
+	start := time.Now()
+	return s.observe("apply", start, s.Store.Apply(ctx, b))
+}
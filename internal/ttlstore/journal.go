@@ -0,0 +1,280 @@
+package ttlstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// when journal appends are flushed to disk
+type SyncPolicy int
+
+const (
+	SyncPeriodic SyncPolicy = iota // every JournalSyncInterval
+	SyncAlways                     // before each change returns, concurrent changes share a sync
+	SyncNever                      // left to the OS
+)
+
+const JournalSyncInterval = time.Second
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "", "periodic":
+		return SyncPeriodic, nil
+	case "always":
+		return SyncAlways, nil
+	case "never":
+		return SyncNever, nil
+	default:
+		return 0, fmt.Errorf("invalid sync policy: %v", s)
+	}
+}
+
+// journal operations
+const (
+	opAdd    = "add"
+	opSet    = "set"
+	opRemove = "remove"
+	opDelete = "delete"
+	opBatch  = "batch" // of entries applied together
+)
+
+// a change, one JSON line in the journal
+type journalEntry struct {
+	Op      string
+	Key     string
+	Value   []byte         `json:",omitempty"`
+	Expires uint32         `json:",omitempty"`
+	Batch   []journalEntry `json:",omitempty"`
+}
+
+// gets the path of the journal of the snapshot at path
+func JournalPath(path string) string {
+	return path + ".journal"
+}
+
+// gets the path of the journal segment being compacted into the snapshot at path
+func oldJournalPath(path string) string {
+	return path + ".journal.old"
+}
+
+// an append-only log of changes since the last snapshot
+type journal struct {
+	mu          sync.Mutex
+	cond        sync.Cond // broadcast when a sync finishes
+	path        string    // of the snapshot
+	f           *os.File
+	policy      SyncPolicy
+	onSyncError func() // called after a failed sync, entries since the last sync may be lost
+	appended    uint64 // entries appended
+	synced      uint64 // entries appended before the last successful sync
+	syncing     bool   // mu is released while syncing
+	err         error  // of the last sync, appends fail until a sync succeeds
+}
+
+// opens the journal of the snapshot at path for appending, dropping any partially written last entry.
+// failed syncs are retried every JournalSyncInterval.
+func openJournal(path string, policy SyncPolicy, onSyncError func()) (*journal, error) {
+	b, err := os.ReadFile(JournalPath(path))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		if err = os.Truncate(JournalPath(path), int64(bytes.LastIndexByte(b, '\n')+1)); err != nil {
+			return nil, err
+		}
+	}
+	j := &journal{path: path, policy: policy, onSyncError: onSyncError}
+	j.cond.L = &j.mu
+	if err = j.open(); err != nil {
+		return nil, err
+	}
+	if policy != SyncNever {
+		go j.syncPeriodically()
+	}
+	return j, nil
+}
+
+func (j *journal) open() (err error) {
+	j.f, err = os.OpenFile(JournalPath(j.path), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	return
+}
+
+// appends e, returning its sequence number for wait
+func (j *journal) append(e *journalEntry) (uint64, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return 0, os.ErrClosed
+	}
+	if j.err != nil {
+		return 0, j.err
+	}
+	if _, err = j.f.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+	j.appended++
+	return j.appended, nil
+}
+
+// waits until entry n is synced if required by the policy. entries appended meanwhile are synced
+// together, so callers shouldn't hold locks that appends need.
+func (j *journal) wait(n uint64) error {
+	if j.policy != SyncAlways {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for j.synced < n {
+		if j.syncing {
+			j.cond.Wait()
+			continue
+		}
+		if err := j.sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncs the entries appended so far, or retries a failed sync. called with mu held, which is
+// released while syncing.
+func (j *journal) sync() error {
+	for j.syncing {
+		j.cond.Wait()
+	}
+	if j.f == nil {
+		return os.ErrClosed
+	}
+	n := j.appended
+	if j.synced == n && j.err == nil {
+		return nil
+	}
+	j.syncing = true
+	f := j.f
+	j.mu.Unlock()
+	err := f.Sync()
+	j.mu.Lock()
+	j.syncing = false
+	j.cond.Broadcast()
+	if err != nil {
+		j.err = err
+		if j.onSyncError != nil {
+			j.onSyncError()
+		}
+		return err
+	}
+	j.synced = n
+	j.err = nil
+	return nil
+}
+
+func (j *journal) syncPeriodically() {
+	for {
+		time.Sleep(JournalSyncInterval)
+		j.mu.Lock()
+		if j.f == nil {
+			j.mu.Unlock()
+			return
+		}
+		j.sync()
+		j.mu.Unlock()
+	}
+}
+
+// moves the journal aside to be removed once a snapshot including it is written, and starts a new one.
+// the journal is kept if a previous segment is still waiting for a snapshot.
+func (j *journal) rotate() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for j.syncing {
+		j.cond.Wait()
+	}
+	if j.f == nil {
+		return os.ErrClosed
+	}
+	if _, err := os.Stat(oldJournalPath(j.path)); err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+	j.synced = j.appended
+	j.f.Close()
+	if err := os.Rename(JournalPath(j.path), oldJournalPath(j.path)); err != nil {
+		j.open()
+		return err
+	}
+	if err := j.open(); err != nil {
+		os.Rename(oldJournalPath(j.path), JournalPath(j.path))
+		j.open()
+		return err
+	}
+	j.err = nil
+	return nil
+}
+
+// removes the old segment, after a snapshot including it is written
+func (j *journal) removeOld() error {
+	err := os.Remove(oldJournalPath(j.path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for j.syncing {
+		j.cond.Wait()
+	}
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Sync()
+	if err == nil {
+		j.synced = j.appended
+	}
+	if err1 := j.f.Close(); err == nil {
+		err = err1
+	}
+	j.f = nil
+	return err
+}
+
+// reads the journal at path, applying each entry. a partially written last entry is ignored.
+func replayJournal(path string, apply func(e *journalEntry)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// no newline, incomplete
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var e journalEntry
+		if err = json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("%v: line %v: %w", path, n, err)
+		}
+		apply(&e)
+	}
+}
@@ -0,0 +1,150 @@
+package ttlstore
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// creates a store journaling to a new snapshot path
+func newJournaledStore(t *testing.T, path string) *SimpleTtlStore {
+	t.Helper()
+	s := new(SimpleTtlStore)
+	if err := s.LoadFile(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("got %v, want %v", err, fs.ErrNotExist)
+	}
+	if err := s.OpenJournal(path, SyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// loads the store at path
+func loadStore(t *testing.T, path string) *SimpleTtlStore {
+	t.Helper()
+	s := new(SimpleTtlStore)
+	if err := s.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestJournalReplay(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "db.bin")
+	s := newJournaledStore(t, path)
+	s.Add(ctx, "a", []byte("1"), 60)
+	s.Add(ctx, "a", []byte("2"), 60)
+	s.Set(ctx, "b", []byte("1"), 60)
+	// compacted into the snapshot
+	if err := s.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	s.Remove(ctx, "a", []byte("1"))
+	s.Delete(ctx, "b")
+	var b Batch
+	b.Set("c", []byte("1"), 60)
+	b.Add("c", []byte("2"), 60)
+	if err := s.Apply(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CloseJournal(); err != nil {
+		t.Fatal(err)
+	}
+	l := loadStore(t, path)
+	checkValues(t, l, "a", "2")
+	checkValues(t, l, "b")
+	checkValues(t, l, "c", "1", "2")
+	if l.Size() != 3 {
+		t.Errorf("got size %v, want 3", l.Size())
+	}
+}
+
+func TestJournalTornTail(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "db.bin")
+	s := newJournaledStore(t, path)
+	s.Set(ctx, "a", []byte("1"), 60)
+	if err := s.CloseJournal(); err != nil {
+		t.Fatal(err)
+	}
+	// a partially written entry, as after a crash
+	f, err := os.OpenFile(JournalPath(path), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Op":"set","Key":"b","Val`)
+	f.Close()
+	s = loadStore(t, path)
+	checkValues(t, s, "a", "1")
+	checkValues(t, s, "b")
+	// the torn entry is dropped, not completed by the next append
+	if err = s.OpenJournal(path, SyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	s.Set(ctx, "c", []byte("1"), 60)
+	if err = s.CloseJournal(); err != nil {
+		t.Fatal(err)
+	}
+	s = loadStore(t, path)
+	checkValues(t, s, "a", "1")
+	checkValues(t, s, "b")
+	checkValues(t, s, "c", "1")
+}
+
+func TestJournalFailedSync(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "db.bin")
+	s := newJournaledStore(t, path)
+	s.Set(ctx, "a", []byte("1"), 60)
+	if err := s.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	// writes to a pipe succeed, syncs fail
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	j := s.journal
+	j.mu.Lock()
+	f := j.f
+	j.f = w
+	j.mu.Unlock()
+	if err = s.Set(ctx, "b", []byte("1"), 60); err == nil {
+		t.Fatal("change succeeded after a failed sync")
+	}
+	if !s.dirty.Load() {
+		t.Error("store not dirty after a failed sync")
+	}
+	// appends fail until a sync succeeds
+	if err = s.Set(ctx, "c", []byte("1"), 60); err == nil {
+		t.Error("change succeeded before a successful sync")
+	}
+	j.mu.Lock()
+	j.f = f
+	err = j.sync()
+	j.mu.Unlock()
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Set(ctx, "d", []byte("1"), 60); err != nil {
+		t.Fatal(err)
+	}
+	// the change with the lost entry is in the next snapshot
+	if err = s.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.CloseJournal(); err != nil {
+		t.Fatal(err)
+	}
+	s = loadStore(t, path)
+	checkValues(t, s, "a", "1")
+	checkValues(t, s, "b", "1")
+	checkValues(t, s, "c")
+	checkValues(t, s, "d", "1")
+}
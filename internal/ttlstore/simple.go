@@ -2,58 +2,144 @@ package ttlstore
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const snapshotChunkKeys = 1000 // keys encoded per read lock when writing a snapshot
+
 type ValueWithExpiration struct {
 	Expires uint32
 	Value   []byte
 }
 
+// an in-memory TtlStore, optionally persisted as a snapshot file plus a journal of changes since
 type SimpleTtlStore struct {
-	MaxSize int
-	mu      sync.RWMutex
-	m       map[string][]ValueWithExpiration
-	size    int
-	dirty   bool
+	MaxSize  int
+	Format   SnapshotFormat // of written snapshots, either format is loaded
+	mu       sync.RWMutex
+	m        map[string][]ValueWithExpiration
+	size     int
+	dirty    atomic.Bool
+	journal  *journal
+	writeMu  sync.Mutex // held while writing a snapshot
+	writeErr error
 }
 
-func (s *SimpleTtlStore) add(key string, val []byte, ttl uint32) error {
+func (s *SimpleTtlStore) add(key string, val []byte, expires uint32) {
 	if s.m == nil {
 		s.m = make(map[string][]ValueWithExpiration)
 	}
-	if s.MaxSize > 0 && s.size >= s.MaxSize {
+	s.m[key] = append(s.m[key], ValueWithExpiration{expires, val})
+	s.size++
+	s.dirty.Store(true)
+}
+
+func (s *SimpleTtlStore) delete(key string) {
+	if s.m[key] != nil {
+		s.size -= len(s.m[key])
+		delete(s.m, key)
+		s.dirty.Store(true)
+	}
+}
+
+func (s *SimpleTtlStore) remove(key string, val []byte) {
+	rs := s.m[key]
+	removed := false
+	for i := 0; i < len(rs); {
+		if bytes.Equal(rs[i].Value, val) {
+			rs = append(rs[:i], rs[i+1:]...)
+			s.size--
+			removed = true
+			continue
+		}
+		i++
+	}
+	if removed {
+		if len(rs) == 0 {
+			delete(s.m, key)
+		} else {
+			s.m[key] = rs
+		}
+		s.dirty.Store(true)
+	}
+}
+
+// checks if the store has room for n more values
+func (s *SimpleTtlStore) checkSize(n int) error {
+	if s.MaxSize > 0 && s.size+n > s.MaxSize {
 		return fmt.Errorf("at max size (%v)", s.size)
 	}
-	s.m[key] = append(s.m[key], ValueWithExpiration{uint32(time.Now().Unix()) + ttl, val})
-	s.size++
-	s.dirty = true
 	return nil
 }
 
-func (s *SimpleTtlStore) Add(key string, val []byte, ttl uint32) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return s.add(key, val, ttl)
+// appends a change to the journal, if open, before it is applied. returns the entry's sequence number,
+// or 0 if not journaled.
+func (s *SimpleTtlStore) log(e *journalEntry) (uint64, error) {
+	if s.journal == nil {
+		return 0, nil
+	}
+	n, err := s.journal.append(e)
+	if err != nil {
+		s.writeErr = err
+	}
+	return n, err
 }
 
-func (s *SimpleTtlStore) Set(key string, val []byte, ttl uint32) error {
+// makes a change with the lock held, then waits for its journal entry to be synced without it
+func (s *SimpleTtlStore) change(f func() (n uint64, err error)) error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.m[key] != nil {
-		s.size -= len(s.m[key])
-		delete(s.m, key)
+	n, err := f()
+	j := s.journal
+	s.mu.Unlock()
+	if err != nil || n == 0 || j == nil {
+		return err
 	}
-	return s.add(key, val, ttl)
+	return j.wait(n)
+}
+
+func (s *SimpleTtlStore) Add(ctx context.Context, key string, val []byte, ttl uint32) error {
+	return s.change(func() (uint64, error) {
+		if err := s.checkSize(1); err != nil {
+			return 0, err
+		}
+		expires := uint32(time.Now().Unix()) + ttl
+		n, err := s.log(&journalEntry{Op: opAdd, Key: key, Value: val, Expires: expires})
+		if err != nil {
+			return 0, err
+		}
+		s.add(key, val, expires)
+		return n, nil
+	})
 }
 
-func (s *SimpleTtlStore) List(prefix string) (keys []string, err error) {
+func (s *SimpleTtlStore) Set(ctx context.Context, key string, val []byte, ttl uint32) error {
+	return s.change(func() (uint64, error) {
+		if err := s.checkSize(1 - len(s.m[key])); err != nil {
+			return 0, err
+		}
+		expires := uint32(time.Now().Unix()) + ttl
+		n, err := s.log(&journalEntry{Op: opSet, Key: key, Value: val, Expires: expires})
+		if err != nil {
+			return 0, err
+		}
+		s.delete(key)
+		s.add(key, val, expires)
+		return n, nil
+	})
+}
+
+func (s *SimpleTtlStore) List(ctx context.Context, prefix string) (keys []string, err error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	for key := range s.m {
@@ -64,7 +150,7 @@ func (s *SimpleTtlStore) List(prefix string) (keys []string, err error) {
 	return
 }
 
-func (s *SimpleTtlStore) Exists(key string) (exists bool, err error) {
+func (s *SimpleTtlStore) Exists(ctx context.Context, key string) (exists bool, err error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	now := uint32(time.Now().Unix())
@@ -76,7 +162,7 @@ func (s *SimpleTtlStore) Exists(key string) (exists bool, err error) {
 	return
 }
 
-func (s *SimpleTtlStore) Values(key string) (vals [][]byte, err error) {
+func (s *SimpleTtlStore) Values(ctx context.Context, key string) (vals [][]byte, err error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	now := uint32(time.Now().Unix())
@@ -88,7 +174,7 @@ func (s *SimpleTtlStore) Values(key string) (vals [][]byte, err error) {
 	return
 }
 
-func (s *SimpleTtlStore) Get(key string) (val []byte, err error) {
+func (s *SimpleTtlStore) Get(ctx context.Context, key string) (val []byte, err error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	now := uint32(time.Now().Unix())
@@ -100,40 +186,87 @@ func (s *SimpleTtlStore) Get(key string) (val []byte, err error) {
 	return
 }
 
-func (s *SimpleTtlStore) Remove(key string, val []byte) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	rs := s.m[key]
-	removed := false
-	for i := 0; i < len(rs); {
-		if bytes.Equal(rs[i].Value, val) {
-			rs = append(rs[:i], rs[i+1:]...)
-			s.size--
-			removed = true
-			continue
+func (s *SimpleTtlStore) Remove(ctx context.Context, key string, val []byte) error {
+	return s.change(func() (uint64, error) {
+		if !slices.ContainsFunc(s.m[key], func(r ValueWithExpiration) bool { return bytes.Equal(r.Value, val) }) {
+			return 0, nil
 		}
-		i++
-	}
-	if removed {
-		if len(rs) == 0 {
-			delete(s.m, key)
-		} else {
-			s.m[key] = rs
+		n, err := s.log(&journalEntry{Op: opRemove, Key: key, Value: val})
+		if err != nil {
+			return 0, err
+		}
+		s.remove(key, val)
+		return n, nil
+	})
+}
+
+func (s *SimpleTtlStore) Delete(ctx context.Context, key string) error {
+	return s.change(func() (uint64, error) {
+		if s.m[key] == nil {
+			return 0, nil
+		}
+		n, err := s.log(&journalEntry{Op: opDelete, Key: key})
+		if err != nil {
+			return 0, err
 		}
-		s.dirty = true
+		s.delete(key)
+		return n, nil
+	})
+}
+
+// applies b under one lock, logged as a single journal entry
+func (s *SimpleTtlStore) Apply(ctx context.Context, b Batch) error {
+	if len(b) == 0 {
+		return nil
 	}
-	return nil
+	return s.change(func() (uint64, error) {
+		return s.applyBatch(b)
+	})
 }
 
-func (s *SimpleTtlStore) Delete(key string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.m[key] != nil {
-		s.size -= len(s.m[key])
-		delete(s.m, key)
-		s.dirty = true
+// applies b with the lock held, returning the sequence number of its journal entry
+func (s *SimpleTtlStore) applyBatch(b Batch) (uint64, error) {
+	// values after the batch by changed key, removes are assumed to remove nothing
+	counts := make(map[string]int)
+	e := &journalEntry{Op: opBatch, Batch: make([]journalEntry, len(b))}
+	now := uint32(time.Now().Unix())
+	for i, op := range b {
+		n, ok := counts[op.Key]
+		if !ok {
+			n = len(s.m[op.Key])
+		}
+		switch op.Type {
+		case OpAdd:
+			e.Batch[i] = journalEntry{Op: opAdd, Key: op.Key, Value: op.Value, Expires: now + op.Ttl}
+			n++
+		case OpSet:
+			e.Batch[i] = journalEntry{Op: opSet, Key: op.Key, Value: op.Value, Expires: now + op.Ttl}
+			n = 1
+		case OpRemove:
+			e.Batch[i] = journalEntry{Op: opRemove, Key: op.Key, Value: op.Value}
+		case OpDelete:
+			e.Batch[i] = journalEntry{Op: opDelete, Key: op.Key}
+			n = 0
+		default:
+			return 0, fmt.Errorf("invalid op type: %v", op.Type)
+		}
+		counts[op.Key] = n
 	}
-	return nil
+	var added int
+	for key, n := range counts {
+		added += n - len(s.m[key])
+	}
+	if err := s.checkSize(added); err != nil {
+		return 0, err
+	}
+	seq, err := s.log(e)
+	if err != nil {
+		return 0, err
+	}
+	for i := range e.Batch {
+		s.apply(&e.Batch[i])
+	}
+	return seq, nil
 }
 
 func (s *SimpleTtlStore) Size() int {
@@ -163,7 +296,7 @@ func (s *SimpleTtlStore) Prune() {
 			} else {
 				s.m[key] = rs
 			}
-			s.dirty = true
+			s.dirty.Store(true)
 		}
 	}
 }
@@ -175,55 +308,177 @@ func (s *SimpleTtlStore) PrunePeriodically(interval time.Duration) {
 	}
 }
 
+// writes a snapshot of the store to path, replacing it atomically. if the journal is open, it is compacted
+// into the snapshot. readers aren't blocked while writing.
 func (s *SimpleTtlStore) WriteFile(path string) error {
+	err := s.writeFile(path)
+	s.mu.Lock()
+	s.writeErr = err
+	s.mu.Unlock()
+	return err
+}
+
+// gets the error of the last write, nil if it succeeded
+func (s *SimpleTtlStore) WriteError() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.writeErr
+}
+
+func (s *SimpleTtlStore) writeFile(path string) (err error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	// list the keys and start a new journal segment while changes are excluded. changes made while
+	// writing may or may not be in the snapshot, but are in the new segment, which is replayed on load.
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.m))
+	for key := range s.m {
+		keys = append(keys, key)
+	}
+	s.dirty.Store(false)
+	if s.journal != nil {
+		err = s.journal.rotate()
+	}
+	s.mu.RUnlock()
+	defer func() {
+		if err != nil {
+			s.dirty.Store(true)
+		}
+	}()
+	if err != nil {
+		return
+	}
 	dir, file := filepath.Split(path)
 	f, err := os.CreateTemp(dir, file)
 	if err != nil {
-		return err
+		return
+	}
+	err = s.encode(f, keys)
+	if err == nil {
+		err = f.Sync()
 	}
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	err = enc.Encode(s.m)
 	if err1 := f.Close(); err1 != nil && err == nil {
 		err = err1
 	}
 	if err == nil {
 		err = os.Rename(f.Name(), path)
 	}
-	if err == nil {
-		s.dirty = false
-	} else {
+	if err != nil {
 		os.Remove(f.Name())
+		return
 	}
-	return err
+	// the old journal segment is now in the snapshot
+	if s.journal != nil {
+		err = s.journal.removeOld()
+	}
+	return
 }
 
-func (s *SimpleTtlStore) WriteFilePeriodically(path string, interval time.Duration) error {
-	for {
-		time.Sleep(interval)
+// encodes the current values of keys to w in chunks, excluding changes only while a chunk is encoded
+func (s *SimpleTtlStore) encode(w io.Writer, keys []string) error {
+	e := newSnapshotEncoder(s.Format)
+	for len(keys) > 0 {
+		n := min(len(keys), snapshotChunkKeys)
 		s.mu.RLock()
-		dirty := s.dirty
+		var err error
+		for _, key := range keys[:n] {
+			if rs := s.m[key]; len(rs) > 0 {
+				if err = e.encode(key, rs); err != nil {
+					break
+				}
+			}
+		}
 		s.mu.RUnlock()
-		if dirty {
-			if err := s.WriteFile(path); err != nil {
-				return err
+		if err != nil {
+			return err
+		}
+		if err = e.flush(w); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return e.close(w)
+}
+
+// writes the store to path every interval if changed. failed writes are retried, reporting errors to
+// onError if not nil.
+func (s *SimpleTtlStore) WriteFilePeriodically(path string, interval time.Duration, onError func(error)) {
+	for {
+		time.Sleep(interval)
+		if s.dirty.Load() {
+			if err := s.WriteFile(path); err != nil && onError != nil {
+				onError(err)
 			}
 		}
 	}
 }
 
-func (s *SimpleTtlStore) LoadFile(path string) error {
-	f, err := os.Open(path)
+// opens the journal of the snapshot at path, logging subsequent changes. LoadFile should be called first.
+func (s *SimpleTtlStore) OpenJournal(path string, policy SyncPolicy) error {
+	// entries since the last sync may be lost after a failed sync, the next snapshot includes them
+	j, err := openJournal(path, policy, func() { s.dirty.Store(true) })
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	var m map[string][]ValueWithExpiration
-	if err = json.NewDecoder(f).Decode(&m); err != nil {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.journal = j
+	return nil
+}
+
+// flushes and closes the journal
+func (s *SimpleTtlStore) CloseJournal() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.journal == nil {
+		return nil
+	}
+	err := s.journal.close()
+	s.journal = nil
+	return err
+}
+
+// applies a journal entry. existing values aren't added again, so entries already in the snapshot can be
+// replayed.
+func (s *SimpleTtlStore) replay(e *journalEntry) {
+	switch e.Op {
+	case opAdd:
+		if slices.ContainsFunc(s.m[e.Key], func(r ValueWithExpiration) bool {
+			return r.Expires == e.Expires && bytes.Equal(r.Value, e.Value)
+		}) {
+			return
+		}
+	case opBatch:
+		for i := range e.Batch {
+			s.replay(&e.Batch[i])
+		}
+		return
+	}
+	s.apply(e)
+}
+
+// applies a single change
+func (s *SimpleTtlStore) apply(e *journalEntry) {
+	switch e.Op {
+	case opAdd:
+		s.add(e.Key, e.Value, e.Expires)
+	case opSet:
+		s.delete(e.Key)
+		s.add(e.Key, e.Value, e.Expires)
+	case opRemove:
+		s.remove(e.Key, e.Value)
+	case opDelete:
+		s.delete(e.Key)
+	}
+}
+
+// loads the snapshot at path, then replays its journal. returns fs.ErrNotExist if neither exist.
+func (s *SimpleTtlStore) LoadFile(path string) error {
+	m, err := loadSnapshot(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return err
 	}
+	notExist := err
 	var size int
 	for _, rs := range m {
 		size += len(rs)
@@ -232,5 +487,25 @@ func (s *SimpleTtlStore) LoadFile(path string) error {
 	defer s.mu.Unlock()
 	s.m = m
 	s.size = size
-	return nil
+	for _, journalPath := range []string{oldJournalPath(path), JournalPath(path)} {
+		err = replayJournal(journalPath, s.replay)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		notExist = nil
+	}
+	return notExist
+}
+
+func loadSnapshot(path string) (m map[string][]ValueWithExpiration, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	m, _, err = DecodeSnapshot(f)
+	return
 }
@@ -0,0 +1,264 @@
+package ttlstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+type SnapshotFormat int
+
+const (
+	SnapshotBinary SnapshotFormat = iota
+	SnapshotJSON                  // legacy, indented
+)
+
+func ParseSnapshotFormat(s string) (SnapshotFormat, error) {
+	switch s {
+	case "binary":
+		return SnapshotBinary, nil
+	case "json":
+		return SnapshotJSON, nil
+	default:
+		return 0, fmt.Errorf("invalid snapshot format: %v", s)
+	}
+}
+
+func (f SnapshotFormat) String() string {
+	if f == SnapshotJSON {
+		return "json"
+	}
+	return "binary"
+}
+
+// the binary snapshot format, version 1:
+//
+//	magic "addrttl", version byte
+//	for each key: byte 1, uvarint key length, key, uvarint value count,
+//	  for each value: uint32 expiration, uvarint value length, value
+//	byte 0, uint32 CRC-32C of all preceding bytes
+//
+// integers are big-endian.
+const (
+	snapshotMagic        = "addrttl"
+	snapshotVersion      = 1
+	maxSnapshotFieldSize = 1 << 20 // limits allocations before the checksum is verified
+)
+
+var (
+	crc32c              = crc32.MakeTable(crc32.Castagnoli)
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+)
+
+// gets the format of the snapshot at path
+func DetectSnapshotFormat(path string) (SnapshotFormat, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	header := make([]byte, len(snapshotMagic))
+	if _, err = io.ReadFull(f, header); err != nil || string(header) != snapshotMagic {
+		return SnapshotJSON, nil
+	}
+	return SnapshotBinary, nil
+}
+
+// encodes a snapshot in parts, buffering the encoded bytes until flushed
+type snapshotEncoder struct {
+	format SnapshotFormat
+	buf    bytes.Buffer
+	crc    hash.Hash32
+	count  int
+}
+
+func newSnapshotEncoder(format SnapshotFormat) *snapshotEncoder {
+	e := &snapshotEncoder{format: format, crc: crc32.New(crc32c)}
+	if format == SnapshotJSON {
+		e.buf.WriteByte('{')
+	} else {
+		e.buf.WriteString(snapshotMagic)
+		e.buf.WriteByte(snapshotVersion)
+	}
+	return e
+}
+
+// encodes the values of key
+func (e *snapshotEncoder) encode(key string, rs []ValueWithExpiration) error {
+	if e.format == SnapshotJSON {
+		// same as the indented encoding of the whole map
+		k, _ := json.Marshal(key)
+		v, err := json.MarshalIndent(rs, "  ", "  ")
+		if err != nil {
+			return err
+		}
+		if e.count > 0 {
+			e.buf.WriteByte(',')
+		}
+		e.buf.WriteString("\n  ")
+		e.buf.Write(k)
+		e.buf.WriteString(": ")
+		e.buf.Write(v)
+	} else {
+		b := e.buf.AvailableBuffer()
+		b = append(b, 1)
+		b = binary.AppendUvarint(b, uint64(len(key)))
+		b = append(b, key...)
+		b = binary.AppendUvarint(b, uint64(len(rs)))
+		for _, r := range rs {
+			b = binary.BigEndian.AppendUint32(b, r.Expires)
+			b = binary.AppendUvarint(b, uint64(len(r.Value)))
+			b = append(b, r.Value...)
+		}
+		e.buf.Write(b)
+	}
+	e.count++
+	return nil
+}
+
+// writes the buffered bytes to w
+func (e *snapshotEncoder) flush(w io.Writer) error {
+	e.crc.Write(e.buf.Bytes())
+	_, err := e.buf.WriteTo(w)
+	return err
+}
+
+// ends the snapshot, writing the remaining bytes to w
+func (e *snapshotEncoder) close(w io.Writer) error {
+	if e.format == SnapshotJSON {
+		if e.count > 0 {
+			e.buf.WriteByte('\n')
+		}
+		e.buf.WriteString("}\n")
+		return e.flush(w)
+	}
+	e.buf.WriteByte(0)
+	if err := e.flush(w); err != nil {
+		return err
+	}
+	_, err := w.Write(e.crc.Sum(nil))
+	return err
+}
+
+// writes m to w
+func EncodeSnapshot(w io.Writer, m map[string][]ValueWithExpiration, format SnapshotFormat) error {
+	bw := bufio.NewWriter(w)
+	e := newSnapshotEncoder(format)
+	for key, rs := range m {
+		if err := e.encode(key, rs); err != nil {
+			return err
+		}
+		if err := e.flush(bw); err != nil {
+			return err
+		}
+	}
+	if err := e.close(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// a reader hashing the bytes read
+type hashingReader struct {
+	*bufio.Reader
+	h hash.Hash32
+}
+
+func (r *hashingReader) ReadByte() (byte, error) {
+	c, err := r.Reader.ReadByte()
+	if err == nil {
+		r.h.Write([]byte{c})
+	}
+	return c, err
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.h.Write(p[:n])
+	return n, err
+}
+
+func (r *hashingReader) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSnapshotFieldSize {
+		return nil, fmt.Errorf("snapshot field too large: %v", n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+// reads a snapshot in either format from r
+func DecodeSnapshot(r io.Reader) (m map[string][]ValueWithExpiration, format SnapshotFormat, err error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len(snapshotMagic) + 1)
+	if err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		// legacy
+		err = json.NewDecoder(br).Decode(&m)
+		return m, SnapshotJSON, err
+	}
+	if header[len(snapshotMagic)] != snapshotVersion {
+		return nil, SnapshotBinary, fmt.Errorf("unsupported snapshot version: %v", header[len(snapshotMagic)])
+	}
+	hr := &hashingReader{br, crc32.New(crc32c)}
+	if _, err = io.ReadFull(hr, make([]byte, len(header))); err != nil {
+		return nil, SnapshotBinary, err
+	}
+	m = make(map[string][]ValueWithExpiration)
+	for {
+		more, err := hr.ReadByte()
+		if err != nil {
+			return nil, SnapshotBinary, unexpectedEOF(err)
+		}
+		if more == 0 {
+			break
+		}
+		key, err := hr.readBytes()
+		if err != nil {
+			return nil, SnapshotBinary, unexpectedEOF(err)
+		}
+		count, err := binary.ReadUvarint(hr)
+		if err != nil {
+			return nil, SnapshotBinary, unexpectedEOF(err)
+		}
+		if count > maxSnapshotFieldSize {
+			return nil, SnapshotBinary, fmt.Errorf("snapshot value count too large: %v", count)
+		}
+		rs := make([]ValueWithExpiration, count)
+		for i := range rs {
+			if err = binary.Read(hr, binary.BigEndian, &rs[i].Expires); err != nil {
+				return nil, SnapshotBinary, unexpectedEOF(err)
+			}
+			if rs[i].Value, err = hr.readBytes(); err != nil {
+				return nil, SnapshotBinary, unexpectedEOF(err)
+			}
+		}
+		m[string(key)] = rs
+	}
+	sum := hr.h.Sum32()
+	var stored uint32
+	if err = binary.Read(br, binary.BigEndian, &stored); err != nil {
+		return nil, SnapshotBinary, unexpectedEOF(err)
+	}
+	if stored != sum {
+		return nil, SnapshotBinary, ErrSnapshotChecksum
+	}
+	return m, SnapshotBinary, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
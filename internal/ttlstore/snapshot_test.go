@@ -0,0 +1,76 @@
+package ttlstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var testSnapshot = map[string][]ValueWithExpiration{
+	"a":         {{1700000000, []byte("1")}},
+	"b:ip6":     {{1700000000, []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}}},
+	"challenge": {{1700000000, []byte("value1")}, {1800000000, []byte("value2")}},
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, format := range []SnapshotFormat{SnapshotBinary, SnapshotJSON} {
+		var buf bytes.Buffer
+		if err := EncodeSnapshot(&buf, testSnapshot, format); err != nil {
+			t.Fatal(err)
+		}
+		m, got, err := DecodeSnapshot(&buf)
+		if err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		if got != format {
+			t.Errorf("%v: decoded as %v", format, got)
+		}
+		if !reflect.DeepEqual(m, testSnapshot) {
+			t.Errorf("%v: got %v, want %v", format, m, testSnapshot)
+		}
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	ctx := context.Background()
+	for _, format := range []SnapshotFormat{SnapshotBinary, SnapshotJSON} {
+		path := filepath.Join(t.TempDir(), "db")
+		s := &SimpleTtlStore{Format: format}
+		for i := 0; i < snapshotChunkKeys+1; i++ {
+			s.Add(ctx, string(rune('a'+i%26))+string(rune('a'+i/26)), []byte("1"), 60)
+		}
+		s.Add(ctx, "aa", []byte("2"), 60)
+		if err := s.WriteFile(path); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := DetectSnapshotFormat(path); err != nil || got != format {
+			t.Errorf("%v: detected %v, %v", format, got, err)
+		}
+		l := loadStore(t, path)
+		if !reflect.DeepEqual(l.m, s.m) || l.Size() != s.Size() {
+			t.Errorf("%v: loaded store differs", format)
+		}
+		checkValues(t, l, "aa", "1", "2")
+	}
+}
+
+func TestSnapshotChecksum(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeSnapshot(&buf, testSnapshot, SnapshotBinary); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	i := bytes.Index(b, []byte("value1"))
+	b[i] ^= 1
+	if _, _, err := DecodeSnapshot(bytes.NewReader(b)); !errors.Is(err, ErrSnapshotChecksum) {
+		t.Errorf("got %v, want %v", err, ErrSnapshotChecksum)
+	}
+	b[i] ^= 1
+	if _, _, err := DecodeSnapshot(bytes.NewReader(b[:len(b)-2])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
@@ -1,29 +1,74 @@
 package ttlstore
 
+import (
+	"context"
+	"sync"
+)
+
+// a store of values which expire. operations that may block, such as on a remote store, give up when ctx is done.
 type TtlStore interface {
 	// appends val to any other values associated with key
-	Add(key string, val []byte, ttl uint32) error
+	Add(ctx context.Context, key string, val []byte, ttl uint32) error
 
 	// associates val with key, replacing any other values
-	Set(key string, val []byte, ttl uint32) error
+	Set(ctx context.Context, key string, val []byte, ttl uint32) error
 
 	// gets all keys starting with prefix
-	List(prefix string) (keys []string, err error)
+	List(ctx context.Context, prefix string) (keys []string, err error)
 
 	// checks if key has any non-expired values
-	Exists(key string) (exists bool, err error)
+	Exists(ctx context.Context, key string) (exists bool, err error)
 
 	// gets all non-expired values associated with key
-	Values(key string) (vals [][]byte, err error)
+	Values(ctx context.Context, key string) (vals [][]byte, err error)
 
 	// gets the first non-expired value associated with key
-	Get(key string) (val []byte, err error)
+	Get(ctx context.Context, key string) (val []byte, err error)
 
 	// unassociates val with key, leaving any other values
-	Remove(key string, val []byte) error
+	Remove(ctx context.Context, key string, val []byte) error
 
 	// deletes all values associated with key
-	Delete(key string) error
+	Delete(ctx context.Context, key string) error
+
+	// makes the changes in b, in order, atomically
+	Apply(ctx context.Context, b Batch) error
+}
+
+type OpType uint8
+
+const (
+	OpAdd OpType = iota
+	OpSet
+	OpRemove
+	OpDelete
+)
+
+// a change, as made by the TtlStore method of the same name
+type Op struct {
+	Type  OpType
+	Key   string
+	Value []byte
+	Ttl   uint32
+}
+
+// changes to be applied together
+type Batch []Op
+
+func (b *Batch) Add(key string, val []byte, ttl uint32) {
+	*b = append(*b, Op{OpAdd, key, val, ttl})
+}
+
+func (b *Batch) Set(key string, val []byte, ttl uint32) {
+	*b = append(*b, Op{OpSet, key, val, ttl})
+}
+
+func (b *Batch) Remove(key string, val []byte) {
+	*b = append(*b, Op{OpRemove, key, val, 0})
+}
+
+func (b *Batch) Delete(key string) {
+	*b = append(*b, Op{OpDelete, key, nil, 0})
 }
 
 type Prefixed struct {
@@ -35,38 +80,114 @@ func (p *Prefixed) WithPrefix(key string) string {
 	return p.Prefix + key
 }
 
-func (p *Prefixed) Add(key string, val []byte, ttl uint32) error {
-	return p.Store.Add(p.WithPrefix(key), val, ttl)
+func (p *Prefixed) Add(ctx context.Context, key string, val []byte, ttl uint32) error {
+	return p.Store.Add(ctx, p.WithPrefix(key), val, ttl)
 }
 
-func (p *Prefixed) Set(key string, val []byte, ttl uint32) error {
-	return p.Store.Set(p.WithPrefix(key), val, ttl)
+func (p *Prefixed) Set(ctx context.Context, key string, val []byte, ttl uint32) error {
+	return p.Store.Set(ctx, p.WithPrefix(key), val, ttl)
 }
 
-func (p *Prefixed) List(prefix string) (keys []string, err error) {
-	keys, err = p.Store.List(p.WithPrefix(prefix))
+func (p *Prefixed) List(ctx context.Context, prefix string) (keys []string, err error) {
+	keys, err = p.Store.List(ctx, p.WithPrefix(prefix))
 	for i, v := range keys {
 		keys[i] = v[len(p.Prefix):]
 	}
 	return
 }
 
-func (p *Prefixed) Exists(key string) (exists bool, err error) {
-	return p.Store.Exists(p.WithPrefix(key))
+func (p *Prefixed) Exists(ctx context.Context, key string) (exists bool, err error) {
+	return p.Store.Exists(ctx, p.WithPrefix(key))
+}
+
+func (p *Prefixed) Values(ctx context.Context, key string) (vals [][]byte, err error) {
+	return p.Store.Values(ctx, p.WithPrefix(key))
+}
+
+func (p *Prefixed) Get(ctx context.Context, key string) (val []byte, err error) {
+	return p.Store.Get(ctx, p.WithPrefix(key))
+}
+
+func (p *Prefixed) Remove(ctx context.Context, key string, val []byte) error {
+	return p.Store.Remove(ctx, p.WithPrefix(key), val)
+}
+
+func (p *Prefixed) Delete(ctx context.Context, key string) error {
+	return p.Store.Delete(ctx, p.WithPrefix(key))
+}
+
+func (p *Prefixed) Apply(ctx context.Context, b Batch) error {
+	prefixed := make(Batch, len(b))
+	for i, op := range b {
+		op.Key = p.WithPrefix(op.Key)
+		prefixed[i] = op
+	}
+	return p.Store.Apply(ctx, prefixed)
+}
+
+// a TtlStore which calls its observers after each successful modification
+type Observed struct {
+	Store     TtlStore
+	mu        sync.RWMutex
+	observers []func(key string)
+}
+
+func (o *Observed) Observe(f func(key string)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.observers = append(o.observers, f)
+}
+
+func (o *Observed) changed(key string, err error) error {
+	if err != nil {
+		return err
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	for _, f := range o.observers {
+		f(key)
+	}
+	return nil
+}
+
+func (o *Observed) Add(ctx context.Context, key string, val []byte, ttl uint32) error {
+	return o.changed(key, o.Store.Add(ctx, key, val, ttl))
+}
+
+func (o *Observed) Set(ctx context.Context, key string, val []byte, ttl uint32) error {
+	return o.changed(key, o.Store.Set(ctx, key, val, ttl))
 }
 
-func (p *Prefixed) Values(key string) (vals [][]byte, err error) {
-	return p.Store.Values(p.WithPrefix(key))
+func (o *Observed) List(ctx context.Context, prefix string) (keys []string, err error) {
+	return o.Store.List(ctx, prefix)
 }
 
-func (p *Prefixed) Get(key string) (val []byte, err error) {
-	return p.Store.Get(p.WithPrefix(key))
+func (o *Observed) Exists(ctx context.Context, key string) (exists bool, err error) {
+	return o.Store.Exists(ctx, key)
 }
 
-func (p *Prefixed) Remove(key string, val []byte) error {
-	return p.Store.Remove(p.WithPrefix(key), val)
+func (o *Observed) Values(ctx context.Context, key string) (vals [][]byte, err error) {
+	return o.Store.Values(ctx, key)
 }
 
-func (p *Prefixed) Delete(key string) error {
-	return p.Store.Delete(p.WithPrefix(key))
+func (o *Observed) Get(ctx context.Context, key string) (val []byte, err error) {
+	return o.Store.Get(ctx, key)
+}
+
+func (o *Observed) Remove(ctx context.Context, key string, val []byte) error {
+	return o.changed(key, o.Store.Remove(ctx, key, val))
+}
+
+func (o *Observed) Delete(ctx context.Context, key string) error {
+	return o.changed(key, o.Store.Delete(ctx, key))
+}
+
+func (o *Observed) Apply(ctx context.Context, b Batch) error {
+	if err := o.Store.Apply(ctx, b); err != nil {
+		return err
+	}
+	for _, op := range b {
+		o.changed(op.Key, nil)
+	}
+	return nil
 }
@@ -0,0 +1,106 @@
+package ttlstore
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// checks the values of key in s
+func checkValues(t *testing.T, s TtlStore, key string, want ...string) {
+	t.Helper()
+	vals, err := s.Values(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, v := range vals {
+		got = append(got, string(v))
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("%v: got values %q, want %q", key, got, want)
+	}
+}
+
+// checks that batches are applied in order and all or nothing
+func testApply(t *testing.T, s TtlStore) {
+	ctx := context.Background()
+	if err := s.Set(ctx, "a", []byte("1"), 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(ctx, "b", []byte("1"), 60); err != nil {
+		t.Fatal(err)
+	}
+	var b Batch
+	b.Add("a", []byte("2"), 60)
+	b.Remove("a", []byte("1"))
+	b.Delete("b")
+	b.Set("c", []byte("1"), 60)
+	b.Add("c", []byte("2"), 60)
+	if err := s.Apply(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, s, "a", "2")
+	checkValues(t, s, "b")
+	checkValues(t, s, "c", "1", "2")
+	// an unknown op rejects the whole batch
+	b = nil
+	b.Delete("a")
+	b.Set("d", []byte("1"), 60)
+	b = append(b, Op{Type: OpDelete + 1, Key: "c"})
+	if err := s.Apply(ctx, b); err == nil {
+		t.Error("batch with an unknown op applied")
+	}
+	checkValues(t, s, "a", "2")
+	checkValues(t, s, "c", "1", "2")
+	checkValues(t, s, "d")
+}
+
+func TestSimpleTtlStoreApply(t *testing.T) {
+	testApply(t, new(SimpleTtlStore))
+}
+
+func TestSimpleTtlStoreApplyMaxSize(t *testing.T) {
+	ctx := context.Background()
+	s := &SimpleTtlStore{MaxSize: 2}
+	if err := s.Add(ctx, "a", []byte("1"), 60); err != nil {
+		t.Fatal(err)
+	}
+	var b Batch
+	b.Set("a", []byte("2"), 60)
+	b.Add("b", []byte("1"), 60)
+	if err := s.Apply(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	// over the max size only part way through
+	b = nil
+	b.Add("c", []byte("1"), 60)
+	b.Delete("a")
+	if err := s.Apply(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	b = nil
+	b.Delete("c")
+	b.Add("d", []byte("1"), 60)
+	b.Add("d", []byte("2"), 60)
+	if err := s.Apply(ctx, b); err == nil {
+		t.Error("batch over the max size applied")
+	}
+	checkValues(t, s, "a")
+	checkValues(t, s, "b", "1")
+	checkValues(t, s, "c", "1")
+	checkValues(t, s, "d")
+	if s.Size() != 2 {
+		t.Errorf("got size %v, want 2", s.Size())
+	}
+}
+
+func TestBoltTtlStoreApply(t *testing.T) {
+	s, err := OpenBoltTtlStore(filepath.Join(t.TempDir(), "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testApply(t, s)
+}
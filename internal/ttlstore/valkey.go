@@ -16,16 +16,22 @@ type ValkeyClient struct {
 	CommandTimeout time.Duration
 }
 
-func (c *ValkeyClient) ctx() (context.Context, context.CancelFunc) {
+// limits ctx to the command timeout
+func (c *ValkeyClient) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
 	timeout := c.CommandTimeout
 	if timeout == 0 {
 		timeout = DefaultCommandTimeout
 	}
-	return context.WithTimeout(context.Background(), timeout)
+	return context.WithTimeout(ctx, timeout)
 }
 
-func (c *ValkeyClient) Add(key string, val []byte, ttl uint32) error {
-	ctx, done := c.ctx()
+// checks that the server is reachable
+func (c *ValkeyClient) Ping(ctx context.Context) error {
+	return c.Do(ctx, c.B().Ping().Build()).Error()
+}
+
+func (c *ValkeyClient) Add(ctx context.Context, key string, val []byte, ttl uint32) error {
+	ctx, done := c.withTimeout(ctx)
 	defer done()
 	return c.Do(
 		ctx,
@@ -33,8 +39,8 @@ func (c *ValkeyClient) Add(key string, val []byte, ttl uint32) error {
 	).Error()
 }
 
-func (c *ValkeyClient) Set(key string, val []byte, ttl uint32) error {
-	ctx, done := c.ctx()
+func (c *ValkeyClient) Set(ctx context.Context, key string, val []byte, ttl uint32) error {
+	ctx, done := c.withTimeout(ctx)
 	defer done()
 	results := c.DoMulti(
 		ctx,
@@ -51,8 +57,8 @@ func (c *ValkeyClient) Set(key string, val []byte, ttl uint32) error {
 	return nil
 }
 
-func (c *ValkeyClient) List(prefix string) (keys []string, err error) {
-	ctx, done := c.ctx()
+func (c *ValkeyClient) List(ctx context.Context, prefix string) (keys []string, err error) {
+	ctx, done := c.withTimeout(ctx)
 	defer done()
 	var page valkey.ScanEntry
 	seen := make(map[string]struct{})
@@ -76,14 +82,14 @@ func (c *ValkeyClient) List(prefix string) (keys []string, err error) {
 	return
 }
 
-func (c *ValkeyClient) Exists(key string) (bool, error) {
-	ctx, done := c.ctx()
+func (c *ValkeyClient) Exists(ctx context.Context, key string) (bool, error) {
+	ctx, done := c.withTimeout(ctx)
 	defer done()
 	return c.Do(ctx, c.B().Exists().Key(key).Build()).AsBool()
 }
 
-func (c *ValkeyClient) Values(key string) ([][]byte, error) {
-	ctx, done := c.ctx()
+func (c *ValkeyClient) Values(ctx context.Context, key string) ([][]byte, error) {
+	ctx, done := c.withTimeout(ctx)
 	defer done()
 	values, err := c.Do(ctx, c.B().Hkeys().Key(key).Build()).AsStrSlice()
 	if len(values) == 0 || err != nil {
@@ -96,8 +102,8 @@ func (c *ValkeyClient) Values(key string) ([][]byte, error) {
 	return out, nil
 }
 
-func (c *ValkeyClient) Get(key string) ([]byte, error) {
-	ctx, done := c.ctx()
+func (c *ValkeyClient) Get(ctx context.Context, key string) ([]byte, error) {
+	ctx, done := c.withTimeout(ctx)
 	defer done()
 	values, err := c.Do(ctx, c.B().Hkeys().Key(key).Build()).ToArray()
 	if len(values) == 0 || err != nil {
@@ -106,14 +112,56 @@ func (c *ValkeyClient) Get(key string) ([]byte, error) {
 	return values[0].AsBytes()
 }
 
-func (c *ValkeyClient) Remove(key string, val []byte) error {
-	ctx, done := c.ctx()
+func (c *ValkeyClient) Remove(ctx context.Context, key string, val []byte) error {
+	ctx, done := c.withTimeout(ctx)
 	defer done()
 	return c.Do(ctx, c.B().Hdel().Key(key).Field(valkey.BinaryString(val)).Build()).Error()
 }
 
-func (c *ValkeyClient) Delete(key string) error {
-	ctx, done := c.ctx()
+func (c *ValkeyClient) Delete(ctx context.Context, key string) error {
+	ctx, done := c.withTimeout(ctx)
 	defer done()
 	return c.Do(ctx, c.B().Del().Key(key).Build()).Error()
 }
+
+// applies b in a MULTI/EXEC transaction
+func (c *ValkeyClient) Apply(ctx context.Context, b Batch) error {
+	if len(b) == 0 {
+		return nil
+	}
+	cmds := make(valkey.Commands, 0, len(b)+3)
+	cmds = append(cmds, c.B().Multi().Build())
+	for _, op := range b {
+		switch op.Type {
+		case OpSet:
+			cmds = append(cmds, c.B().Del().Key(op.Key).Build())
+			fallthrough
+		case OpAdd:
+			cmds = append(cmds, c.B().Hsetex().Key(op.Key).Ex(int64(op.Ttl)).Fields().Numfields(1).FieldValue().FieldValue(valkey.BinaryString(op.Value), "").Build())
+		case OpRemove:
+			cmds = append(cmds, c.B().Hdel().Key(op.Key).Field(valkey.BinaryString(op.Value)).Build())
+		case OpDelete:
+			cmds = append(cmds, c.B().Del().Key(op.Key).Build())
+		}
+	}
+	cmds = append(cmds, c.B().Exec().Build())
+	ctx, done := c.withTimeout(ctx)
+	defer done()
+	results := c.DoMulti(ctx, cmds...)
+	for _, result := range results {
+		if err := result.Error(); err != nil {
+			return err
+		}
+	}
+	// commands failing within the transaction don't fail EXEC
+	replies, err := results[len(results)-1].ToArray()
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if err = reply.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,11 +2,13 @@ package challenges
 
 import (
 	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 
+	"github.com/brianshea2/addr.tools/internal/dnsutil"
 	"github.com/brianshea2/addr.tools/internal/httputil"
 	"github.com/brianshea2/addr.tools/internal/ttlstore"
 )
@@ -16,6 +18,12 @@ const ChallengeTtl = 120
 type HTTPHandler struct {
 	ChallengeStore ttlstore.TtlStore
 	Zone           string
+	TsigKey        []byte // derives TSIG secrets, rfc2136 updates are disabled if empty
+}
+
+// the TSIG secret of name, derived from the server's key so that nothing is stored
+func TsigSecret(key []byte, name string) []byte {
+	return dnsutil.DeriveTsigSecret(key, "challenges", name)
 }
 
 func IsValidChallenge(s string) bool {
@@ -48,6 +56,7 @@ func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
 		return
 	}
+	ctx := req.Context()
 	// parse request
 	values := httputil.ParseRequest(req)
 	// require "secret" (any string is valid)
@@ -94,6 +103,10 @@ func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	// calculate domain
 	domain := fmt.Sprintf("%x.%s", sha256.Sum224([]byte(secret)), h.Zone)
+	// rfc2136 updates are signed with a secret derived from the domain
+	if len(h.TsigKey) > 0 {
+		w.Header().Set("X-Tsig-Secret", base64.StdEncoding.EncodeToString(TsigSecret(h.TsigKey, domain)))
+	}
 	switch req.Method {
 	case http.MethodDelete:
 		// require "txt"
@@ -102,7 +115,7 @@ func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 		// delete
-		err = h.ChallengeStore.Remove(domain, []byte(txt))
+		err = h.ChallengeStore.Remove(ctx, domain, []byte(txt))
 		if err != nil {
 			log.Printf("[error] challenges.HTTPHandler.ServeHTTP: delete challenge: %v", err)
 			http.Error(w, "server error", http.StatusInternalServerError)
@@ -117,7 +130,7 @@ func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 		// add
-		err = h.ChallengeStore.Add(domain, []byte(txt), ChallengeTtl)
+		err = h.ChallengeStore.Add(ctx, domain, []byte(txt), ChallengeTtl)
 		if err != nil {
 			log.Printf("[error] challenges.HTTPHandler.ServeHTTP: add challenge: %v", err)
 			http.Error(w, "server error", http.StatusInternalServerError)
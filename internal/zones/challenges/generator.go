@@ -1,6 +1,7 @@
 package challenges
 
 import (
+	"context"
 	"github.com/brianshea2/addr.tools/internal/dnsutil"
 	"github.com/brianshea2/addr.tools/internal/ttlstore"
 	"github.com/miekg/dns"
@@ -8,6 +9,7 @@ import (
 
 type RecordGenerator struct {
 	ChallengeStore ttlstore.TtlStore
+	TsigKey        []byte // derives TSIG secrets, rfc2136 updates are disabled if empty
 }
 
 func IsValidSubdomain(sub string) bool {
@@ -28,11 +30,11 @@ func IsValidSubdomain(sub string) bool {
 	return true
 }
 
-func (g *RecordGenerator) GenerateRecords(q *dns.Question, zone string) (rrs []dns.RR, validName bool, err error) {
+func (g *RecordGenerator) GenerateRecords(ctx context.Context, q *dns.Question, zone string) (rrs []dns.RR, validName bool, err error) {
 	if IsValidSubdomain(q.Name[:len(q.Name)-len(zone)]) {
 		validName = true
 		if q.Qtype == dns.TypeTXT {
-			vals, err := g.ChallengeStore.Values(dnsutil.ToLowerAscii(q.Name))
+			vals, err := g.ChallengeStore.Values(ctx, dnsutil.ToLowerAscii(q.Name))
 			if err != nil {
 				return nil, false, err
 			}
@@ -51,3 +53,30 @@ func (g *RecordGenerator) GenerateRecords(q *dns.Question, zone string) (rrs []d
 	}
 	return
 }
+
+func (g *RecordGenerator) ListTypes(ctx context.Context, name, zone string) (types []uint16, err error) {
+	if !IsValidSubdomain(name[:len(name)-len(zone)]) {
+		return
+	}
+	vals, err := g.ChallengeStore.Values(ctx, dnsutil.ToLowerAscii(name))
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) > 0 {
+		types = append(types, dns.TypeTXT)
+	}
+	return
+}
+
+func (g *RecordGenerator) ListNames(ctx context.Context, zone string) (names []string, err error) {
+	keys, err := g.ChallengeStore.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if dns.IsSubDomain(zone, key) && IsValidSubdomain(key[:len(key)-len(zone)]) {
+			names = append(names, key)
+		}
+	}
+	return
+}
@@ -0,0 +1,62 @@
+package challenges
+
+import (
+	"context"
+	"strings"
+
+	"github.com/brianshea2/addr.tools/internal/dnsutil"
+	"github.com/brianshea2/addr.tools/internal/ttlstore"
+	"github.com/miekg/dns"
+)
+
+func (g *RecordGenerator) TsigSecret(ctx context.Context, keyName, zone string) ([]byte, error) {
+	if len(g.TsigKey) == 0 || !IsValidSubdomain(keyName[:len(keyName)-len(zone)]) {
+		return nil, nil
+	}
+	return TsigSecret(g.TsigKey, keyName), nil
+}
+
+func (g *RecordGenerator) UpdateRecords(ctx context.Context, update []dns.RR, zone, keyName string) (int, error) {
+	// keys from other zones, e.g. transfer keys, may be valid
+	if len(keyName) <= len(zone) || !dns.IsSubDomain(zone, keyName) || !IsValidSubdomain(keyName[:len(keyName)-len(zone)]) {
+		return dns.RcodeRefused, nil
+	}
+	if len(update) == 0 {
+		return dns.RcodeRefused, nil
+	}
+	// only TXT records owned by keyName
+	for _, rr := range update {
+		hdr := rr.Header()
+		if !dnsutil.EqualsAsciiIgnoreCase(hdr.Name, keyName) {
+			return dns.RcodeRefused, nil
+		}
+		switch hdr.Rrtype {
+		case dns.TypeTXT:
+			if hdr.Class != dns.ClassANY && !IsValidChallenge(strings.Join(rr.(*dns.TXT).Txt, "")) {
+				return dns.RcodeRefused, nil
+			}
+		case dns.TypeANY:
+			if hdr.Class != dns.ClassANY {
+				return dns.RcodeRefused, nil
+			}
+		default:
+			return dns.RcodeRefused, nil
+		}
+	}
+	// all or nothing, as rfc2136 requires
+	var b ttlstore.Batch
+	for _, rr := range update {
+		switch rr.Header().Class {
+		case dns.ClassINET:
+			b.Add(keyName, []byte(strings.Join(rr.(*dns.TXT).Txt, "")), ChallengeTtl)
+		case dns.ClassANY:
+			b.Delete(keyName)
+		case dns.ClassNONE:
+			b.Remove(keyName, []byte(strings.Join(rr.(*dns.TXT).Txt, "")))
+		}
+	}
+	if err := g.ChallengeStore.Apply(ctx, b); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	return dns.RcodeSuccess, nil
+}
@@ -26,7 +26,14 @@ func (p *BadDnssecProvider) Prove(req, resp *dns.Msg, validFrom, validTo uint32)
 	if p == nil {
 		return nil
 	}
-	err := p.DnssecProvider.Prove(req, resp, validFrom, validTo)
+	return p.ProveWith(req, resp, validFrom, validTo, &dnsutil.ProofOptions{Nsec3: p.Nsec3})
+}
+
+func (p *BadDnssecProvider) ProveWith(req, resp *dns.Msg, validFrom, validTo uint32, opts *dnsutil.ProofOptions) error {
+	if p == nil {
+		return nil
+	}
+	err := p.DnssecProvider.ProveWith(req, resp, validFrom, validTo, opts)
 	if err != nil {
 		return err
 	}
@@ -58,7 +65,11 @@ type DnscheckHandler struct {
 	Watchers             WatcherHub
 	IPInfoClient         *httputil.IPInfoClient
 	BadDnssecProvider    *BadDnssecProvider
-	soaSig               atomic.Pointer[dns.RRSIG]
+	Cookies              *dnsutil.ServerCookies
+	Nsid                 string             // server identity returned to clients requesting it (rfc5001)
+	Timers               dnsutil.ZoneTimers // record ttls are fixed, only SOA timers and the NS ttl apply
+	serial               uint32
+	soaSigs              atomic.Pointer[[]dns.RR]
 }
 
 func (h *DnscheckHandler) initSoaSig() {
@@ -69,16 +80,16 @@ func (h *DnscheckHandler) initSoaSig() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	h.soaSig.Store(sigs[0].(*dns.RRSIG))
+	h.soaSigs.Store(&sigs)
 	go func() {
 		for {
 			time.Sleep(time.Duration(rand.Int63n(int64(ttl/2))+int64(ttl/2)) * time.Second)
 			now = uint32(time.Now().Unix())
-			sigs, err = h.DnssecProvider.Sign(soa, now-3600, now+3600+2*ttl)
+			sigs, err := h.DnssecProvider.Sign(soa, now-3600, now+3600+2*ttl)
 			if err != nil {
 				log.Fatal(err)
 			}
-			h.soaSig.Store(sigs[0].(*dns.RRSIG))
+			h.soaSigs.Store(&sigs)
 		}
 	}()
 }
@@ -93,14 +104,11 @@ func (h *DnscheckHandler) Init(privKeyBytes []byte) *DnscheckHandler {
 	} else {
 		h.HostMasterMbox = dns.CanonicalName(h.HostMasterMbox)
 	}
+	h.Timers.SetDefaults()
+	// records only change with the config
+	h.serial = uint32(time.Now().Unix())
 	if h.DnssecProvider != nil {
-		h.DnssecProvider.SigningKey.Hdr.Name = h.Zone
-		h.DnssecProvider.SigningKey.Hdr.Rrtype = dns.TypeDNSKEY
-		h.DnssecProvider.SigningKey.Hdr.Class = dns.ClassINET
-		h.DnssecProvider.SigningKey.Hdr.Ttl = 1800
-		h.DnssecProvider.SigningKey.Flags = 257  // Secure Entry Point
-		h.DnssecProvider.SigningKey.Protocol = 3 // DNSSEC
-		err := h.DnssecProvider.SetPrivKeyBytes(privKeyBytes)
+		err := h.DnssecProvider.Init(h.Zone, 1800, privKeyBytes)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -125,32 +133,16 @@ func (h *DnscheckHandler) SOA(q *dns.Question, includeSig bool) (rrs []dns.RR) {
 	} else {
 		name = q.Name[len(q.Name)-len(h.Zone):]
 	}
-	if includeSig {
-		rrs = make([]dns.RR, 1, 2)
-	} else {
-		rrs = make([]dns.RR, 1)
-	}
-	rrs[0] = &dns.SOA{
-		Hdr: dns.RR_Header{
-			Name:   name,
-			Rrtype: dns.TypeSOA,
-			Class:  dns.ClassINET,
-			Ttl:    1800,
-		},
-		Ns:      h.Ns[0],
-		Mbox:    h.HostMasterMbox,
-		Serial:  1,
-		Refresh: 1800,
-		Retry:   1800,
-		Expire:  3600,
-		Minttl:  1800,
-	}
+	rrs = make([]dns.RR, 1)
+	rrs[0] = h.Timers.SOA(name, h.Ns[0], h.HostMasterMbox, h.serial)
 	if !includeSig {
 		return
 	}
-	if sig := h.soaSig.Load(); sig != nil {
-		rrs = append(rrs, dns.Copy(sig))
-		rrs[1].Header().Name = name
+	if sigs := h.soaSigs.Load(); sigs != nil {
+		for _, sig := range *sigs {
+			rrs = append(rrs, dns.Copy(sig))
+			rrs[len(rrs)-1].Header().Name = name
+		}
 	}
 	return
 }
@@ -180,7 +172,7 @@ func (h *DnscheckHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		}
 	}()
 	// edns
-	err := dnsutil.CheckAndSetEdns(req, resp)
+	err := dnsutil.CheckAndSetEdns(w, req, resp, h.Cookies, h.Nsid)
 	if err != nil {
 		// Rcode already set by CheckAndSetEdns
 		return
@@ -195,7 +187,7 @@ func (h *DnscheckHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	case dns.TypeOPT, dns.TypeNXNAME:
 		resp.Rcode = dns.RcodeFormatError
 		return
-	case dns.TypeRRSIG, dns.TypeNSEC:
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
 		resp.Rcode = dns.RcodeRefused
 		return
 	case dns.TypeANY:
@@ -227,7 +219,7 @@ func (h *DnscheckHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 			if opts != nil && opts.Compress {
 				resp.Compress = true
 			}
-		case dnsutil.ProtoTLS:
+		case dnsutil.ProtoTLS, dnsutil.ProtoHTTPS, dnsutil.ProtoQUIC:
 			if dnsutil.HasPadding(req) {
 				dnsutil.AddPadding(resp, dnsutil.ResponsePaddingBlockLength)
 			}
@@ -248,11 +240,17 @@ func (h *DnscheckHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 				validFrom -= resp.Ns[0].Header().Ttl
 			}
 		}
+		proofOpts := new(dnsutil.ProofOptions)
+		if opts != nil && opts.Nsec3 {
+			proofOpts.Nsec3 = &dnsutil.Nsec3Params{Iterations: uint16(opts.Nsec3Iter), OptOut: opts.OptOut}
+		} else if h.DnssecProvider != nil {
+			proofOpts.Nsec3 = h.Nsec3
+		}
 		var err error
 		if opts != nil && opts.BadSig {
-			err = h.BadDnssecProvider.Prove(req, resp, validFrom, validTo)
+			err = h.BadDnssecProvider.ProveWith(req, resp, validFrom, validTo, proofOpts)
 		} else {
-			err = h.DnssecProvider.Prove(req, resp, validFrom, validTo)
+			err = h.DnssecProvider.ProveWith(req, resp, validFrom, validTo, proofOpts)
 		}
 		if err != nil {
 			log.Printf("[error] DnssecProvider.Prove: %v", err)
@@ -280,17 +278,17 @@ func (h *DnscheckHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 			opt := req.IsEdns0()
 			resp.Answer = append(resp.Answer, h.SOA(q, opt != nil && opt.Do())...)
 		case dns.TypeNS:
-			for _, ns := range h.Ns {
-				resp.Answer = append(resp.Answer, &dns.NS{
-					Hdr: dns.RR_Header{
-						Name:   q.Name,
-						Rrtype: dns.TypeNS,
-						Class:  dns.ClassINET,
-						Ttl:    1800,
-					},
-					Ns: ns,
-				})
+			resp.Answer = append(resp.Answer, h.Timers.NS(q.Name, h.Ns)...)
+		case dns.TypeCDS, dns.TypeCDNSKEY:
+			rrs, err := h.DnssecProvider.Cds(q.Name, q.Qtype)
+			if err != nil {
+				log.Printf("[error] DnscheckHandler.ServeDNS (%v): DnssecProvider.Cds: %v", h.Zone, err)
+				resp = new(dns.Msg).SetRcode(req, dns.RcodeServerFailure)
+				return
 			}
+			resp.Answer = append(resp.Answer, rrs...)
+		case dns.TypeNSEC3PARAM:
+			resp.Answer = append(resp.Answer, h.DnssecProvider.Nsec3Param(q.Name)...)
 		}
 	}
 	// static records
@@ -20,6 +20,9 @@ type Options struct {
 	Rcode      int // nxdomain, refused
 	NullIP     bool
 	TxtFill    int // 1 - 4096
+	Nsec3      bool
+	Nsec3Iter  int // 0 - 50; default 0
+	OptOut     bool
 }
 
 func ParseOptions(sub string) *Options {
@@ -108,6 +111,23 @@ func ParseOptions(sub string) *Options {
 			if o.TxtFill < 1 || o.TxtFill > 4096 {
 				return nil
 			}
+		case dnsutil.HasPrefixAsciiIgnoreCase(s, "nsec3") && isDigits(s[5:]):
+			if o.Nsec3 {
+				return nil
+			}
+			o.Nsec3 = true
+			if len(s) > 5 {
+				var err error
+				o.Nsec3Iter, err = strconv.Atoi(s[5:])
+				if err != nil || o.Nsec3Iter < 0 || o.Nsec3Iter > dnsutil.Nsec3MaxIterations {
+					return nil
+				}
+			}
+		case dnsutil.EqualsAsciiIgnoreCase(s, "optout"):
+			if o.OptOut {
+				return nil
+			}
+			o.OptOut = true
 		default:
 			if len(o.Random) > 0 || len(s) < 1 || len(s) > 8 {
 				return nil
@@ -126,5 +146,19 @@ func ParseOptions(sub string) *Options {
 			o.Random = dnsutil.ToLowerAscii(s)
 		}
 	}
+	// optout requires nsec3
+	if o.OptOut && !o.Nsec3 {
+		return nil
+	}
 	return o
 }
+
+// reports whether s is empty or only ascii digits
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/brianshea2/addr.tools/internal/metrics"
 	"github.com/gorilla/websocket"
 	"github.com/miekg/dns"
 )
@@ -22,6 +23,11 @@ const (
 	WebsocketWriteWait           = time.Second
 )
 
+var websocketDropped = metrics.NewCounter(
+	"addrd_dnscheck_websocket_dropped_total",
+	"DNS requests not sent to websocket watchers because the buffer was full or the watcher was done.",
+)
+
 type WebsocketWatcherMessage struct {
 	req     *dns.Msg
 	proto   string
@@ -106,6 +112,7 @@ func (ws *WebsocketWatcher) Send(req *dns.Msg, proto string, remoteAddr net.Addr
 	case ws.ch <- &WebsocketWatcherMessage{req, proto, remoteAddr, connState, ws.conn.Subprotocol(), uint32(time.Now().Unix())}:
 	default:
 		// buffer is full or watcher is done (nil ch)
+		websocketDropped.Inc()
 	}
 }
 
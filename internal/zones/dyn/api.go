@@ -1,7 +1,10 @@
 package dyn
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -10,11 +13,15 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/brianshea2/addr.tools/internal/dnsutil"
 	"github.com/brianshea2/addr.tools/internal/httputil"
 	"github.com/brianshea2/addr.tools/internal/ttlstore"
 )
 
-const AddressTtl = 90 * 86400
+const (
+	AddressTtl   = 90 * 86400
+	TsigSaltSize = 16
+)
 
 type AddressRecord struct {
 	Updated uint32
@@ -38,9 +45,9 @@ func (r *AddressRecord) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
-func LoadIPv4(name string, store ttlstore.TtlStore) (ip *AddressRecord, err error) {
+func LoadIPv4(ctx context.Context, name string, store ttlstore.TtlStore) (ip *AddressRecord, err error) {
 	var data []byte
-	data, err = store.Get(name + ":ip4")
+	data, err = store.Get(ctx, name+":ip4")
 	if err == nil && data != nil {
 		ip = new(AddressRecord)
 		err = ip.UnmarshalBinary(data)
@@ -48,9 +55,9 @@ func LoadIPv4(name string, store ttlstore.TtlStore) (ip *AddressRecord, err erro
 	return
 }
 
-func LoadIPv6(name string, store ttlstore.TtlStore) (ip *AddressRecord, err error) {
+func LoadIPv6(ctx context.Context, name string, store ttlstore.TtlStore) (ip *AddressRecord, err error) {
 	var data []byte
-	data, err = store.Get(name + ":ip6")
+	data, err = store.Get(ctx, name+":ip6")
 	if err == nil && data != nil {
 		ip = new(AddressRecord)
 		err = ip.UnmarshalBinary(data)
@@ -58,7 +65,8 @@ func LoadIPv6(name string, store ttlstore.TtlStore) (ip *AddressRecord, err erro
 	return
 }
 
-func UpdateIP(name string, ip net.IP, store ttlstore.TtlStore) error {
+// adds setting the address of name to b
+func BatchUpdateIP(b *ttlstore.Batch, name string, ip net.IP) error {
 	var suffix string
 	if ip4 := ip.To4(); ip4 != nil {
 		ip = ip4
@@ -73,12 +81,50 @@ func UpdateIP(name string, ip net.IP, store ttlstore.TtlStore) error {
 	if err != nil {
 		return err
 	}
-	return store.Set(name+suffix, data, AddressTtl)
+	b.Set(name+suffix, data, AddressTtl)
+	return nil
+}
+
+func UpdateIP(ctx context.Context, name string, ip net.IP, store ttlstore.TtlStore) error {
+	var b ttlstore.Batch
+	if err := BatchUpdateIP(&b, name, ip); err != nil {
+		return err
+	}
+	return store.Apply(ctx, b)
+}
+
+// adds deleting both addresses of name to b
+func BatchDeleteIPs(b *ttlstore.Batch, name string) {
+	b.Delete(name + ":ip4")
+	b.Delete(name + ":ip6")
+}
+
+// gets the salt of the TSIG secret of name, or nil if rfc2136 updates are disabled
+func LoadTsigSalt(ctx context.Context, name string, store ttlstore.TtlStore) ([]byte, error) {
+	return store.Get(ctx, name+":tsig")
+}
+
+// adds setting the salt of the TSIG secret of name to b, a new random one if salt is nil
+func BatchUpdateTsigSalt(b *ttlstore.Batch, name string, salt []byte) ([]byte, error) {
+	if salt == nil {
+		salt = make([]byte, TsigSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+	}
+	b.Set(name+":tsig", salt, AddressTtl)
+	return salt, nil
+}
+
+// the TSIG secret of name, derived from the server's key so that the stored salt is not a credential
+func TsigSecret(key []byte, name string, salt []byte) []byte {
+	return dnsutil.DeriveTsigSecret(key, "dyn", name, string(salt))
 }
 
 type HTTPHandler struct {
 	DataStore ttlstore.TtlStore
 	Zone      string
+	TsigKey   []byte // derives TSIG secrets, rfc2136 updates are disabled if empty
 }
 
 func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -90,6 +136,7 @@ func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
 		return
 	}
+	ctx := req.Context()
 	// parse request
 	values := httputil.ParseRequest(req)
 	// require "secret" (any string is valid)
@@ -152,11 +199,11 @@ func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, "delete removes all addresses, do not specify \"ip\"", http.StatusBadRequest)
 			return
 		}
-		// delete
-		err = h.DataStore.Delete(domain + ":ip4")
-		if err == nil {
-			err = h.DataStore.Delete(domain + ":ip6")
-		}
+		// delete, disabling rfc2136 updates until the next update over http
+		var b ttlstore.Batch
+		BatchDeleteIPs(&b, domain)
+		b.Delete(domain + ":tsig")
+		err = h.DataStore.Apply(ctx, b)
 		if err != nil {
 			log.Printf("[error] dyn.HTTPHandler.ServeHTTP: Delete: %v", err)
 			http.Error(w, "server error", http.StatusInternalServerError)
@@ -171,12 +218,35 @@ func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 		// update ip
-		err = UpdateIP(domain, ip, h.DataStore)
+		var b ttlstore.Batch
+		err = BatchUpdateIP(&b, domain, ip)
 		if err != nil {
 			log.Printf("[error] dyn.HTTPHandler.ServeHTTP: UpdateIP: %v", err)
 			http.Error(w, "server error", http.StatusInternalServerError)
 			return
 		}
+		// enable rfc2136 updates, keeping the TSIG secret if already enabled
+		var salt []byte
+		if len(h.TsigKey) > 0 {
+			salt, err = LoadTsigSalt(ctx, domain, h.DataStore)
+			if err == nil {
+				salt, err = BatchUpdateTsigSalt(&b, domain, salt)
+			}
+			if err != nil {
+				log.Printf("[error] dyn.HTTPHandler.ServeHTTP: UpdateTsigSalt: %v", err)
+				http.Error(w, "server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		err = h.DataStore.Apply(ctx, b)
+		if err != nil {
+			log.Printf("[error] dyn.HTTPHandler.ServeHTTP: Apply: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if salt != nil {
+			w.Header().Set("X-Tsig-Secret", base64.StdEncoding.EncodeToString(TsigSecret(h.TsigKey, domain, salt)))
+		}
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintln(w, "OK")
@@ -1,7 +1,9 @@
 package dyn
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/brianshea2/addr.tools/internal/dnsutil"
@@ -11,6 +13,7 @@ import (
 
 type RecordGenerator struct {
 	DataStore ttlstore.TtlStore
+	TsigKey   []byte // derives TSIG secrets, rfc2136 updates are disabled if empty
 }
 
 func IsValidSubdomain(sub string) bool {
@@ -31,12 +34,12 @@ func IsValidSubdomain(sub string) bool {
 	return true
 }
 
-func (g *RecordGenerator) GenerateRecords(q *dns.Question, zone string) (rrs []dns.RR, validName bool, err error) {
+func (g *RecordGenerator) GenerateRecords(ctx context.Context, q *dns.Question, zone string) (rrs []dns.RR, validName bool, err error) {
 	if IsValidSubdomain(q.Name[:len(q.Name)-len(zone)]) {
 		validName = true
 		switch q.Qtype {
 		case dns.TypeA:
-			ip, err := LoadIPv4(dnsutil.ToLowerAscii(q.Name), g.DataStore)
+			ip, err := LoadIPv4(ctx, dnsutil.ToLowerAscii(q.Name), g.DataStore)
 			if err != nil {
 				return nil, false, err
 			}
@@ -52,7 +55,7 @@ func (g *RecordGenerator) GenerateRecords(q *dns.Question, zone string) (rrs []d
 				})
 			}
 		case dns.TypeAAAA:
-			ip, err := LoadIPv6(dnsutil.ToLowerAscii(q.Name), g.DataStore)
+			ip, err := LoadIPv6(ctx, dnsutil.ToLowerAscii(q.Name), g.DataStore)
 			if err != nil {
 				return nil, false, err
 			}
@@ -71,14 +74,14 @@ func (g *RecordGenerator) GenerateRecords(q *dns.Question, zone string) (rrs []d
 			txts := make([]string, 1, 3)
 			txts[0] = "v=spf1 -all"
 			name := dnsutil.ToLowerAscii(q.Name)
-			ip, err := LoadIPv4(name, g.DataStore)
+			ip, err := LoadIPv4(ctx, name, g.DataStore)
 			if err != nil {
 				return nil, false, err
 			}
 			if ip != nil {
 				txts = append(txts, fmt.Sprintf("ipv4 last updated %s", time.Unix(int64(ip.Updated), 0).UTC()))
 			}
-			ip, err = LoadIPv6(name, g.DataStore)
+			ip, err = LoadIPv6(ctx, name, g.DataStore)
 			if err != nil {
 				return nil, false, err
 			}
@@ -100,3 +103,48 @@ func (g *RecordGenerator) GenerateRecords(q *dns.Question, zone string) (rrs []d
 	}
 	return
 }
+
+func (g *RecordGenerator) ListTypes(ctx context.Context, name, zone string) (types []uint16, err error) {
+	if !IsValidSubdomain(name[:len(name)-len(zone)]) {
+		return
+	}
+	types = append(types, dns.TypeTXT)
+	name = dnsutil.ToLowerAscii(name)
+	ip, err := LoadIPv4(ctx, name, g.DataStore)
+	if err != nil {
+		return nil, err
+	}
+	if ip != nil {
+		types = append(types, dns.TypeA)
+	}
+	ip, err = LoadIPv6(ctx, name, g.DataStore)
+	if err != nil {
+		return nil, err
+	}
+	if ip != nil {
+		types = append(types, dns.TypeAAAA)
+	}
+	return
+}
+
+func (g *RecordGenerator) ListNames(ctx context.Context, zone string) (names []string, err error) {
+	keys, err := g.DataStore.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{})
+	for _, key := range keys {
+		name, found := strings.CutSuffix(key, ":ip4")
+		if !found {
+			name, found = strings.CutSuffix(key, ":ip6")
+		}
+		if !found || !dns.IsSubDomain(zone, name) || !IsValidSubdomain(name[:len(name)-len(zone)]) {
+			continue
+		}
+		if _, exists := seen[name]; !exists {
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+	return
+}
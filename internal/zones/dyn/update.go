@@ -0,0 +1,144 @@
+package dyn
+
+import (
+	"bytes"
+	"context"
+	"net"
+
+	"github.com/brianshea2/addr.tools/internal/dnsutil"
+	"github.com/brianshea2/addr.tools/internal/ttlstore"
+	"github.com/miekg/dns"
+)
+
+// checks that an rfc2136 update section is not empty and only touches A and AAAA records owned by keyName
+func IsAuthorizedUpdate(update []dns.RR, keyName string) bool {
+	if len(update) == 0 {
+		return false
+	}
+	for _, rr := range update {
+		hdr := rr.Header()
+		if !dnsutil.EqualsAsciiIgnoreCase(hdr.Name, keyName) {
+			return false
+		}
+		switch hdr.Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+		case dns.TypeANY:
+			if hdr.Class != dns.ClassANY {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// adds applying an authorized rfc2136 update section to the addresses stored for name to b
+func BatchUpdate(ctx context.Context, b *ttlstore.Batch, name string, update []dns.RR, store ttlstore.TtlStore) error {
+	// addresses by key suffix as of the ops added so far, nil if deleted
+	current := make(map[string]net.IP)
+	for _, rr := range update {
+		hdr := rr.Header()
+		var suffix string
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			suffix = ":ip4"
+			ip = v.A.To4()
+		case *dns.AAAA:
+			suffix = ":ip6"
+			ip = v.AAAA
+		default:
+			switch hdr.Rrtype {
+			case dns.TypeA:
+				suffix = ":ip4"
+			case dns.TypeAAAA:
+				suffix = ":ip6"
+			}
+		}
+		switch hdr.Class {
+		case dns.ClassINET:
+			// add to rrset (only one address per family is kept)
+			if err := BatchUpdateIP(b, name, ip); err != nil {
+				return err
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				// stored as ipv4, like BatchUpdateIP
+				suffix, ip = ":ip4", ip4
+			}
+			current[suffix] = ip
+		case dns.ClassANY:
+			// delete rrset, or all rrsets if type ANY
+			if len(suffix) > 0 {
+				b.Delete(name + suffix)
+				current[suffix] = nil
+			} else {
+				BatchDeleteIPs(b, name)
+				current[":ip4"] = nil
+				current[":ip6"] = nil
+			}
+		case dns.ClassNONE:
+			// delete rr from rrset
+			cur, ok := current[suffix]
+			if !ok {
+				var r *AddressRecord
+				var err error
+				if suffix == ":ip4" {
+					r, err = LoadIPv4(ctx, name, store)
+				} else {
+					r, err = LoadIPv6(ctx, name, store)
+				}
+				if err != nil {
+					return err
+				}
+				if r != nil {
+					cur = r.IP
+				}
+			}
+			if cur != nil && bytes.Equal(cur, ip) {
+				b.Delete(name + suffix)
+				current[suffix] = nil
+			}
+		}
+	}
+	return nil
+}
+
+func (g *RecordGenerator) TsigSecret(ctx context.Context, keyName, zone string) ([]byte, error) {
+	if len(g.TsigKey) == 0 || !IsValidSubdomain(keyName[:len(keyName)-len(zone)]) {
+		return nil, nil
+	}
+	salt, err := LoadTsigSalt(ctx, keyName, g.DataStore)
+	if salt == nil || err != nil {
+		return nil, err
+	}
+	return TsigSecret(g.TsigKey, keyName, salt), nil
+}
+
+func (g *RecordGenerator) UpdateRecords(ctx context.Context, update []dns.RR, zone, keyName string) (int, error) {
+	// keys from other zones, e.g. transfer keys, may be valid
+	if len(keyName) <= len(zone) || !dns.IsSubDomain(zone, keyName) || !IsValidSubdomain(keyName[:len(keyName)-len(zone)]) {
+		return dns.RcodeRefused, nil
+	}
+	if !IsAuthorizedUpdate(update, keyName) {
+		return dns.RcodeRefused, nil
+	}
+	var b ttlstore.Batch
+	if err := BatchUpdate(ctx, &b, keyName, update, g.DataStore); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	// keep rfc2136 updates enabled as long as the addresses, like updates over http
+	salt, err := LoadTsigSalt(ctx, keyName, g.DataStore)
+	if err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	if salt != nil {
+		if _, err = BatchUpdateTsigSalt(&b, keyName, salt); err != nil {
+			return dns.RcodeServerFailure, err
+		}
+	}
+	if err = g.DataStore.Apply(ctx, b); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	return dns.RcodeSuccess, nil
+}
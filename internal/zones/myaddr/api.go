@@ -1,8 +1,10 @@
 package myaddr
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -15,6 +17,7 @@ import (
 
 	"github.com/brianshea2/addr.tools/internal/dnsutil"
 	"github.com/brianshea2/addr.tools/internal/httputil"
+	"github.com/brianshea2/addr.tools/internal/metrics"
 	"github.com/brianshea2/addr.tools/internal/ttlstore"
 	"github.com/brianshea2/addr.tools/internal/zones/challenges"
 	"github.com/brianshea2/addr.tools/internal/zones/dyn"
@@ -25,6 +28,11 @@ const (
 	RegistrationTtl = 120 * 86400
 )
 
+var (
+	registrations = metrics.NewCounter("addrd_myaddr_registrations_total", "New myaddr registrations.")
+	updates       = metrics.NewCounterVec("addrd_myaddr_updates_total", "Successful myaddr updates by method.", "method")
+)
+
 type RegistrationRecord struct {
 	Created uint32
 	Updated uint32
@@ -56,9 +64,9 @@ func (r *RegistrationRecord) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
-func LoadRegistration(name string, store ttlstore.TtlStore) (reg *RegistrationRecord, err error) {
+func LoadRegistration(ctx context.Context, name string, store ttlstore.TtlStore) (reg *RegistrationRecord, err error) {
 	var data []byte
-	data, err = store.Get(name + ":reg")
+	data, err = store.Get(ctx, name+":reg")
 	if err == nil && data != nil {
 		reg = new(RegistrationRecord)
 		err = reg.UnmarshalBinary(data)
@@ -66,9 +74,10 @@ func LoadRegistration(name string, store ttlstore.TtlStore) (reg *RegistrationRe
 	return
 }
 
-func UpdateRegistration(hash, name string, store ttlstore.TtlStore) error {
+// adds updating the registration of name, or starting a pending one, to b
+func BatchUpdateRegistration(ctx context.Context, b *ttlstore.Batch, hash, name string, store ttlstore.TtlStore) error {
 	now := uint32(time.Now().Unix())
-	reg, err := LoadRegistration(name, store)
+	reg, err := LoadRegistration(ctx, name, store)
 	if err != nil {
 		return err
 	}
@@ -86,11 +95,19 @@ func UpdateRegistration(hash, name string, store ttlstore.TtlStore) error {
 	if err != nil {
 		return err
 	}
-	err = store.Set(name+":reg", data, ttl)
-	if err == nil && len(hash) > 0 {
-		err = store.Set("hash:"+hash, []byte(name), ttl)
+	b.Set(name+":reg", data, ttl)
+	if len(hash) > 0 {
+		b.Set("hash:"+hash, []byte(name), ttl)
+	}
+	return nil
+}
+
+func UpdateRegistration(ctx context.Context, hash, name string, store ttlstore.TtlStore) error {
+	var b ttlstore.Batch
+	if err := BatchUpdateRegistration(ctx, &b, hash, name, store); err != nil {
+		return err
 	}
-	return err
+	return store.Apply(ctx, b)
 }
 
 func IsValidName(s string) bool {
@@ -123,11 +140,12 @@ type AdminHandler struct {
 }
 
 func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
 	switch req.Method {
 	case http.MethodGet:
 		name := req.URL.Query().Get("name")
 		if len(name) > 0 {
-			reg, err := LoadRegistration(name, h.DataStore)
+			reg, err := LoadRegistration(ctx, name, h.DataStore)
 			if err != nil {
 				log.Printf("[error] myaddr.AdminHandler.ServeHTTP: LoadRegistration: %v", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -137,7 +155,7 @@ func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			json.NewEncoder(w).Encode(reg)
 			return
 		}
-		keys, err := h.DataStore.List("")
+		keys, err := h.DataStore.List(ctx, "")
 		if err != nil {
 			log.Printf("[error] myaddr.AdminHandler.ServeHTTP: List: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -157,7 +175,7 @@ func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, "missing \"name\"", http.StatusBadRequest)
 			return
 		}
-		reg, err := LoadRegistration(name, h.DataStore)
+		reg, err := LoadRegistration(ctx, name, h.DataStore)
 		if err != nil {
 			log.Printf("[error] myaddr.AdminHandler.ServeHTTP: LoadRegistration: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -167,24 +185,22 @@ func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, "registration not found", http.StatusBadRequest)
 			return
 		}
+		var b ttlstore.Batch
 		if len(reg.Hash) > 0 {
-			err = h.DataStore.Delete("hash:" + reg.Hash)
-		}
-		if err == nil {
-			err = h.DataStore.Delete(name + ":ip4")
+			b.Delete("hash:" + reg.Hash)
 		}
-		if err == nil {
-			err = h.DataStore.Delete(name + ":ip6")
+		dyn.BatchDeleteIPs(&b, name)
+		if req.Method == "SUSPEND" {
+			err = BatchUpdateRegistration(ctx, &b, "", name, h.DataStore)
+		} else {
+			b.Delete(name + ":reg")
 		}
 		if err == nil {
-			err = h.ChallengeStore.Delete(name)
+			err = h.DataStore.Apply(ctx, b)
 		}
+		// challenges are kept separately, and expire soon if left
 		if err == nil {
-			if req.Method == "SUSPEND" {
-				err = UpdateRegistration("", name, h.DataStore)
-			} else {
-				err = h.DataStore.Delete(name + ":reg")
-			}
+			err = h.ChallengeStore.Delete(ctx, name)
 		}
 		if err != nil {
 			log.Printf("[error] myaddr.AdminHandler.ServeHTTP: %v: %v", req.Method, err)
@@ -213,6 +229,7 @@ func (h *RegistrationHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
 		return
 	}
+	ctx := req.Context()
 	// parse request
 	values := httputil.ParseRequest(req)
 	switch req.Method {
@@ -239,7 +256,7 @@ func (h *RegistrationHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 		}
 		// find name
 		hash := fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
-		nameBytes, err := h.DataStore.Get("hash:" + hash)
+		nameBytes, err := h.DataStore.Get(ctx, "hash:"+hash)
 		if err != nil {
 			log.Printf("[error] myaddr.RegistrationHandler.ServeHTTP: find name: %v", err)
 			http.Error(w, "server error", http.StatusInternalServerError)
@@ -263,7 +280,7 @@ func (h *RegistrationHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 			}{
 				Name: name,
 			}
-			reg, err := LoadRegistration(name, h.DataStore)
+			reg, err := LoadRegistration(ctx, name, h.DataStore)
 			if err != nil {
 				log.Printf("[error] myaddr.RegistrationHandler.ServeHTTP: LoadRegistration: %v", err)
 				http.Error(w, "server error", http.StatusInternalServerError)
@@ -274,7 +291,7 @@ func (h *RegistrationHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 				out.Updated = reg.Updated
 				out.Expires = reg.Expires()
 			}
-			ip, err := dyn.LoadIPv4(name, h.DataStore)
+			ip, err := dyn.LoadIPv4(ctx, name, h.DataStore)
 			if err != nil {
 				log.Printf("[error] myaddr.RegistrationHandler.ServeHTTP: LoadIPv4: %v", err)
 				http.Error(w, "server error", http.StatusInternalServerError)
@@ -283,7 +300,7 @@ func (h *RegistrationHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 			if ip != nil {
 				out.IPv4 = ip.IP
 			}
-			ip, err = dyn.LoadIPv6(name, h.DataStore)
+			ip, err = dyn.LoadIPv6(ctx, name, h.DataStore)
 			if err != nil {
 				log.Printf("[error] myaddr.RegistrationHandler.ServeHTTP: LoadIPv6: %v", err)
 				http.Error(w, "server error", http.StatusInternalServerError)
@@ -296,18 +313,14 @@ func (h *RegistrationHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 			json.NewEncoder(w).Encode(out)
 		case http.MethodDelete:
 			// delete
-			err = h.DataStore.Delete(name + ":ip4")
-			if err == nil {
-				err = h.DataStore.Delete(name + ":ip6")
-			}
-			if err == nil {
-				err = h.DataStore.Delete(name + ":reg")
-			}
+			var b ttlstore.Batch
+			dyn.BatchDeleteIPs(&b, name)
+			b.Delete(name + ":reg")
+			b.Delete("hash:" + hash)
+			err = h.DataStore.Apply(ctx, b)
+			// challenges are kept separately, and expire soon if left
 			if err == nil {
-				err = h.DataStore.Delete("hash:" + hash)
-			}
-			if err == nil {
-				err = h.ChallengeStore.Delete(name)
+				err = h.ChallengeStore.Delete(ctx, name)
 			}
 			if err != nil {
 				log.Printf("[error] myaddr.RegistrationHandler.ServeHTTP: Delete: %v", err)
@@ -365,7 +378,7 @@ func (h *RegistrationHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 		}
 		// check if name already exists
 		name = dnsutil.ToLowerAscii(name) // all names stored in lowercase
-		if exists, err := h.DataStore.Exists(name + ":reg"); err != nil {
+		if exists, err := h.DataStore.Exists(ctx, name+":reg"); err != nil {
 			log.Printf("[error] myaddr.RegistrationHandler.ServeHTTP: name exists: %v", err)
 			http.Error(w, "server error", http.StatusInternalServerError)
 			return
@@ -383,13 +396,14 @@ func (h *RegistrationHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 		}
 		key := fmt.Sprintf("%x", keyBytes)
 		hash := fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
-		err = UpdateRegistration(hash, name, h.DataStore)
+		err = UpdateRegistration(ctx, hash, name, h.DataStore)
 		if err != nil {
 			log.Printf("[error] myaddr.RegistrationHandler.ServeHTTP: UpdateRegistration: %v", err)
 			http.Error(w, "server error", http.StatusInternalServerError)
 			return
 		}
 		// success
+		registrations.Inc()
 		log.Printf("[info] myaddr.RegistrationHandler.ServeHTTP: new registration: %s (%s)", name, req.Header.Get("X-Real-IP"))
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(
@@ -407,6 +421,7 @@ func (h *RegistrationHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 type UpdateHandler struct {
 	DataStore      ttlstore.TtlStore
 	ChallengeStore ttlstore.TtlStore
+	TsigKey        []byte // derives TSIG secrets, rfc2136 updates are disabled if empty
 }
 
 func (h *UpdateHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -418,6 +433,7 @@ func (h *UpdateHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
 		return
 	}
+	ctx := req.Context()
 	// parse request
 	values := httputil.ParseRequest(req)
 	// require "key"
@@ -487,7 +503,7 @@ func (h *UpdateHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	// find name
 	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
-	nameBytes, err := h.DataStore.Get("hash:" + hash)
+	nameBytes, err := h.DataStore.Get(ctx, "hash:"+hash)
 	if err != nil {
 		log.Printf("[error] myaddr.UpdateHandler.ServeHTTP: find name: %v", err)
 		http.Error(w, "server error", http.StatusInternalServerError)
@@ -506,10 +522,9 @@ func (h *UpdateHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 		// delete
-		err = h.DataStore.Delete(name + ":ip4")
-		if err == nil {
-			err = h.DataStore.Delete(name + ":ip6")
-		}
+		var b ttlstore.Batch
+		dyn.BatchDeleteIPs(&b, name)
+		err = h.DataStore.Apply(ctx, b)
 		if err != nil {
 			log.Printf("[error] myaddr.UpdateHandler.ServeHTTP: Delete: %v", err)
 			http.Error(w, "server error", http.StatusInternalServerError)
@@ -522,10 +537,11 @@ func (h *UpdateHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, "must specify either \"ip\" or \"acme_challenge\"", http.StatusBadRequest)
 			return
 		}
+		var b ttlstore.Batch
 		switch {
 		case ip != nil:
-			// update ip
-			err = dyn.UpdateIP(name, ip, h.DataStore)
+			// update ip, applied with the registration
+			err = dyn.BatchUpdateIP(&b, name, ip)
 			if err != nil {
 				log.Printf("[error] myaddr.UpdateHandler.ServeHTTP: UpdateIP: %v", err)
 				http.Error(w, "server error", http.StatusInternalServerError)
@@ -533,7 +549,7 @@ func (h *UpdateHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			}
 		case len(challenge) > 0:
 			// add challenge
-			err = h.ChallengeStore.Add(name, []byte(challenge), challenges.ChallengeTtl)
+			err = h.ChallengeStore.Add(ctx, name, []byte(challenge), challenges.ChallengeTtl)
 			if err != nil {
 				log.Printf("[error] myaddr.UpdateHandler.ServeHTTP: add challenge: %v", err)
 				http.Error(w, "server error", http.StatusInternalServerError)
@@ -541,12 +557,22 @@ func (h *UpdateHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			}
 		}
 		// update registration
-		err = UpdateRegistration(hash, name, h.DataStore)
+		err = BatchUpdateRegistration(ctx, &b, hash, name, h.DataStore)
 		if err != nil {
 			log.Printf("[error] myaddr.UpdateHandler.ServeHTTP: UpdateRegistration: %v", err)
 			http.Error(w, "server error", http.StatusInternalServerError)
 			return
 		}
+		err = h.DataStore.Apply(ctx, b)
+		if err != nil {
+			log.Printf("[error] myaddr.UpdateHandler.ServeHTTP: Apply: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		updates.With("http").Inc()
+		if len(h.TsigKey) > 0 {
+			w.Header().Set("X-Tsig-Secret", base64.StdEncoding.EncodeToString(TsigSecret(h.TsigKey, name, hash)))
+		}
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintln(w, "OK")
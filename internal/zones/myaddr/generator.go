@@ -1,6 +1,7 @@
 package myaddr
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"time"
@@ -14,9 +15,10 @@ import (
 type RecordGenerator struct {
 	DataStore      ttlstore.TtlStore
 	ChallengeStore ttlstore.TtlStore
+	TsigKey        []byte // derives TSIG secrets, rfc2136 updates are disabled if empty
 }
 
-func (g *RecordGenerator) GenerateRecords(q *dns.Question, zone string) (rrs []dns.RR, validName bool, err error) {
+func (g *RecordGenerator) GenerateRecords(ctx context.Context, q *dns.Question, zone string) (rrs []dns.RR, validName bool, err error) {
 	if len(q.Name) == len(zone) {
 		return
 	}
@@ -28,7 +30,7 @@ func (g *RecordGenerator) GenerateRecords(q *dns.Question, zone string) (rrs []d
 		validName = true
 		switch q.Qtype {
 		case dns.TypeA:
-			ip, err := dyn.LoadIPv4(dnsutil.ToLowerAscii(name), g.DataStore)
+			ip, err := dyn.LoadIPv4(ctx, dnsutil.ToLowerAscii(name), g.DataStore)
 			if err != nil {
 				return nil, false, err
 			}
@@ -44,7 +46,7 @@ func (g *RecordGenerator) GenerateRecords(q *dns.Question, zone string) (rrs []d
 				})
 			}
 		case dns.TypeAAAA:
-			ip, err := dyn.LoadIPv6(dnsutil.ToLowerAscii(name), g.DataStore)
+			ip, err := dyn.LoadIPv6(ctx, dnsutil.ToLowerAscii(name), g.DataStore)
 			if err != nil {
 				return nil, false, err
 			}
@@ -65,7 +67,7 @@ func (g *RecordGenerator) GenerateRecords(q *dns.Question, zone string) (rrs []d
 				txts = make([]string, 1, 5)
 				txts[0] = "v=spf1 -all"
 				name = dnsutil.ToLowerAscii(name)
-				reg, err := LoadRegistration(name, g.DataStore)
+				reg, err := LoadRegistration(ctx, name, g.DataStore)
 				if err != nil {
 					return nil, false, err
 				}
@@ -75,14 +77,14 @@ func (g *RecordGenerator) GenerateRecords(q *dns.Question, zone string) (rrs []d
 						fmt.Sprintf("expires %s", time.Unix(int64(reg.Expires()), 0).UTC()),
 					)
 				}
-				ip, err := dyn.LoadIPv4(name, g.DataStore)
+				ip, err := dyn.LoadIPv4(ctx, name, g.DataStore)
 				if err != nil {
 					return nil, false, err
 				}
 				if ip != nil {
 					txts = append(txts, fmt.Sprintf("ipv4 last updated %s", time.Unix(int64(ip.Updated), 0).UTC()))
 				}
-				ip, err = dyn.LoadIPv6(name, g.DataStore)
+				ip, err = dyn.LoadIPv6(ctx, name, g.DataStore)
 				if err != nil {
 					return nil, false, err
 				}
@@ -90,7 +92,7 @@ func (g *RecordGenerator) GenerateRecords(q *dns.Question, zone string) (rrs []d
 					txts = append(txts, fmt.Sprintf("ipv6 last updated %s", time.Unix(int64(ip.Updated), 0).UTC()))
 				}
 			} else if dnsutil.HasPrefixAsciiIgnoreCase(q.Name, "_acme-challenge.") {
-				vals, err := g.ChallengeStore.Values(dnsutil.ToLowerAscii(name))
+				vals, err := g.ChallengeStore.Values(ctx, dnsutil.ToLowerAscii(name))
 				if err != nil {
 					return nil, false, err
 				}
@@ -116,3 +118,71 @@ func (g *RecordGenerator) GenerateRecords(q *dns.Question, zone string) (rrs []d
 	}
 	return
 }
+
+func (g *RecordGenerator) ListTypes(ctx context.Context, fqdn, zone string) (types []uint16, err error) {
+	if len(fqdn) == len(zone) {
+		return
+	}
+	name := fqdn[:len(fqdn)-len(zone)-1]
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name = name[i+1:]
+	}
+	if !IsValidName(name) {
+		return
+	}
+	name = dnsutil.ToLowerAscii(name)
+	if len(fqdn) == len(name)+1+len(zone) {
+		types = append(types, dns.TypeTXT)
+	} else if dnsutil.HasPrefixAsciiIgnoreCase(fqdn, "_acme-challenge.") {
+		vals, err := g.ChallengeStore.Values(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if len(vals) > 0 {
+			types = append(types, dns.TypeTXT)
+		}
+	}
+	ip, err := dyn.LoadIPv4(ctx, name, g.DataStore)
+	if err != nil {
+		return nil, err
+	}
+	if ip != nil {
+		types = append(types, dns.TypeA)
+	}
+	ip, err = dyn.LoadIPv6(ctx, name, g.DataStore)
+	if err != nil {
+		return nil, err
+	}
+	if ip != nil {
+		types = append(types, dns.TypeAAAA)
+	}
+	return
+}
+
+func (g *RecordGenerator) ListNames(ctx context.Context, zone string) (names []string, err error) {
+	keys, err := g.DataStore.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{})
+	for _, key := range keys {
+		name, suffix, found := strings.Cut(key, ":")
+		if !found || !(suffix == "reg" || suffix == "ip4" || suffix == "ip6") || !IsValidName(name) {
+			continue
+		}
+		if _, exists := seen[name]; exists {
+			continue
+		}
+		seen[name] = struct{}{}
+		// addresses are also served at all subdomains
+		names = append(names, name+"."+zone, "*."+name+"."+zone)
+		exists, err := g.ChallengeStore.Exists(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			names = append(names, "_acme-challenge."+name+"."+zone)
+		}
+	}
+	return
+}
@@ -0,0 +1,61 @@
+package myaddr
+
+import (
+	"context"
+
+	"github.com/brianshea2/addr.tools/internal/dnsutil"
+	"github.com/brianshea2/addr.tools/internal/ttlstore"
+	"github.com/brianshea2/addr.tools/internal/zones/dyn"
+	"github.com/miekg/dns"
+)
+
+// the TSIG secret of name, derived from the server's key so that the stored registration hash is not a credential
+func TsigSecret(key []byte, name, hash string) []byte {
+	return dnsutil.DeriveTsigSecret(key, "myaddr", name, hash)
+}
+
+func (g *RecordGenerator) TsigSecret(ctx context.Context, keyName, zone string) ([]byte, error) {
+	if len(g.TsigKey) == 0 || len(keyName) <= len(zone) {
+		return nil, nil
+	}
+	name := keyName[:len(keyName)-len(zone)-1]
+	if !IsValidName(name) {
+		return nil, nil
+	}
+	reg, err := LoadRegistration(ctx, name, g.DataStore)
+	if reg == nil || len(reg.Hash) == 0 || err != nil {
+		return nil, err
+	}
+	return TsigSecret(g.TsigKey, name, reg.Hash), nil
+}
+
+func (g *RecordGenerator) UpdateRecords(ctx context.Context, update []dns.RR, zone, keyName string) (int, error) {
+	// keys from other zones, e.g. transfer keys, may be valid
+	if len(keyName) <= len(zone) || !dns.IsSubDomain(zone, keyName) {
+		return dns.RcodeRefused, nil
+	}
+	name := keyName[:len(keyName)-len(zone)-1]
+	if !IsValidName(name) || !dyn.IsAuthorizedUpdate(update, keyName) {
+		return dns.RcodeRefused, nil
+	}
+	reg, err := LoadRegistration(ctx, name, g.DataStore)
+	if err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	if reg == nil || len(reg.Hash) == 0 {
+		return dns.RcodeRefused, nil
+	}
+	// apply with the registration
+	var b ttlstore.Batch
+	if err = dyn.BatchUpdate(ctx, &b, name, update, g.DataStore); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	if err = BatchUpdateRegistration(ctx, &b, reg.Hash, name, g.DataStore); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	if err = g.DataStore.Apply(ctx, b); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	updates.With("dns").Inc()
+	return dns.RcodeSuccess, nil
+}